@@ -1,81 +1,330 @@
+// Command posixsh is a POSIX shell.
+//
+// It supports the invocation syntax of sh specified by POSIX:
+//
+//	posixsh [-abCefilmnuvx] [-o option]... [command_file [argument...]]
+//	posixsh -c [-abCefilmnuvx] [-o option]... command_string [command_name [argument...]]
+//	posixsh -s [-abCefilmnuvx] [-o option]... [argument...]
+//
+// Options can also be turned off with + instead of -, like "+e" and "+o
+// errexit". Additionally, -print-ast causes the AST of the code to be printed
+// before it is executed, which is useful for debugging.
+//
+// Like other shells, it is a login shell when given -l or when its argv[0]
+// starts with "-", in which case it sources /etc/profile and ~/.profile on
+// startup. Interactive shells then source the file named by $ENV.
 package main
 
 import (
 	"bufio"
-	"flag"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"strings"
 
+	"github.com/elves/posixsh/pkg/edit"
 	"github.com/elves/posixsh/pkg/eval"
 	"github.com/elves/posixsh/pkg/parse"
-	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/cli"
 	"src.elv.sh/pkg/sys"
 )
 
-var (
-	printAST = flag.Bool("print-ast", false, "print AST")
-)
-
 func main() {
-	flag.Parse()
-	args := flag.Args()
-	ev := eval.NewEvaler(os.Args, eval.StdFiles)
-	if len(args) > 0 {
-		f, err := os.Open(args[0])
+	os.Exit(run(os.Args))
+}
+
+type config struct {
+	command     bool // -c
+	stdin       bool // -s
+	interactive bool // -i
+	login       bool // -l
+	printAST    bool // -print-ast
+	options     []option
+	operands    []string
+}
+
+type option struct {
+	name string
+	on   bool
+}
+
+func parseArgs(args []string) (*config, error) {
+	cfg := &config{}
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" || arg == "-" {
+			// Like dash and bash, treat a lone "-" as the end of options too.
+			args = args[1:]
+			break
+		} else if arg == "-print-ast" {
+			cfg.printAST = true
+			args = args[1:]
+			continue
+		} else if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			break
+		}
+		args = args[1:]
+		on := arg[0] == '-'
+		for i := 1; i < len(arg); i++ {
+			switch letter := arg[i]; letter {
+			case 'c', 's', 'i', 'l':
+				// These are not shell options and can't be turned off. Like
+				// dash, ignore them when used with +.
+				if on {
+					switch letter {
+					case 'c':
+						cfg.command = true
+					case 's':
+						cfg.stdin = true
+					case 'i':
+						cfg.interactive = true
+					case 'l':
+						cfg.login = true
+					}
+				}
+			case 'o':
+				if len(args) == 0 {
+					return nil, fmt.Errorf("%co requires an argument", arg[0])
+				}
+				cfg.options = append(cfg.options, option{args[0], on})
+				args = args[1:]
+			default:
+				name, ok := eval.OptionName(letter)
+				if !ok {
+					return nil, fmt.Errorf("unknown option %c%c", arg[0], letter)
+				}
+				cfg.options = append(cfg.options, option{name, on})
+			}
+		}
+	}
+	if cfg.command && cfg.stdin {
+		return nil, errors.New("-c and -s are mutually exclusive")
+	}
+	cfg.operands = args
+	return cfg, nil
+}
+
+func run(args []string) int {
+	cfg, err := parseArgs(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", args[0], err)
+		return eval.StatusBadCommandLine
+	}
+	arg0, operands := args[0], cfg.operands
+	if strings.HasPrefix(arg0, "-") {
+		cfg.login = true
+	}
+	switch {
+	case cfg.command:
+		if len(operands) == 0 {
+			fmt.Fprintf(os.Stderr, "%v: -c requires an argument\n", args[0])
+			return eval.StatusBadCommandLine
+		}
+		code := operands[0]
+		operands = operands[1:]
+		if len(operands) > 0 {
+			arg0, operands = operands[0], operands[1:]
+		}
+		ev, ok := newEvaler(cfg, arg0, operands)
+		if !ok {
+			return eval.StatusBadCommandLine
+		}
+		if status, ok := startup(cfg, ev, false); !ok {
+			return status
+		}
+		return ev.RunExitTrap(evalCode(cfg, ev, code))
+	case cfg.stdin || len(operands) == 0:
+		// POSIX specifies that the shell is interactive when there are no
+		// operands and both stdin and stderr are terminals.
+		interactive := cfg.interactive ||
+			(len(operands) == 0 && sys.IsATTY(os.Stdin.Fd()) && sys.IsATTY(os.Stderr.Fd()))
+		if interactive {
+			// POSIX requires job control to be enabled by default in
+			// interactive shells; it can still be turned off with +m.
+			// Like bash and ksh, use emacs key bindings in the line editor by
+			// default.
+			cfg.options = append([]option{{"monitor", true}, {"emacs", true}}, cfg.options...)
+		}
+		ev, ok := newEvaler(cfg, arg0, operands)
+		if !ok {
+			return eval.StatusBadCommandLine
+		}
+		if interactive {
+			ev.SetInteractive()
+			ev.CatchInteractiveSignals()
+		}
+		if status, ok := startup(cfg, ev, interactive); !ok {
+			return status
+		}
+		if interactive {
+			return repl(cfg, ev)
+		}
+		// Stdin is read without buffering, so that commands can read the rest
+		// of it.
+		return evalAll(cfg, ev, arg0, os.Stdin)
+	default:
+		f, err := os.Open(operands[0])
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Fprintf(os.Stderr, "%v: %v\n", args[0], err)
+			// POSIX requires 127 if the file is not found, and 126 if it is
+			// found but can't be read.
+			if errors.Is(err, fs.ErrNotExist) {
+				return eval.StatusCommandNotFound
+			}
+			return eval.StatusCommandNotExecutable
 		}
 		defer f.Close()
-		evalAll(ev, f)
-		return
-	} else if sys.IsATTY(os.Stdin.Fd()) {
-		repl(ev)
+		ev, ok := newEvaler(cfg, operands[0], operands[1:])
+		if !ok {
+			return eval.StatusBadCommandLine
+		}
+		if status, ok := startup(cfg, ev, false); !ok {
+			return status
+		}
+		// Like stdin, the script is read without buffering, so that the offset
+		// of the file always follows the code read so far.
+		return evalAll(cfg, ev, operands[0], f)
+	}
+}
+
+func newEvaler(cfg *config, arg0 string, args []string) (*eval.Evaler, bool) {
+	ev := eval.NewEvaler(append([]string{arg0}, args...), eval.StdFiles)
+	for _, opt := range cfg.options {
+		if err := ev.SetOption(opt.name, opt.on); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", arg0, err)
+			return nil, false
+		}
+	}
+	return ev, true
+}
+
+// Sources the startup files. Returns false if the shell should exit, which
+// happens when the exit command is called, or when a non-interactive shell
+// encounters a fatal error; the status is the one to exit with.
+func startup(cfg *config, ev *eval.Evaler, interactive bool) (int, bool) {
+	if cfg.login {
+		if status, ok := ev.SourceProfiles(); !ok && (!interactive || ev.Exited()) {
+			return ev.RunExitTrap(status), false
+		}
+	}
+	if interactive {
+		if status, ok := ev.SourceEnv(); !ok && ev.Exited() {
+			return ev.RunExitTrap(status), false
+		}
+	}
+	return 0, true
+}
+
+func repl(cfg *config, ev *eval.Evaler) int {
+	var readCode func() (string, error)
+	isTTY := sys.IsATTY(os.Stdin.Fd())
+	if isTTY {
+		ed := edit.New(edit.Spec{
+			TTY:     cli.NewTTY(os.Stdin, os.Stderr),
+			Prompt:  ev.PS1,
+			Vi:      func() bool { return ev.Option("vi") },
+			History: ev.History,
+		})
+		readCode = ed.ReadCode
 	} else {
-		evalAll(ev, os.Stdin)
+		// The shell can be forced to be interactive with -i when stdin is
+		// not a terminal; the line editor can't be used in that case.
+		stdin := bufio.NewReader(os.Stdin)
+		readCode = func() (string, error) {
+			fmt.Fprint(os.Stderr, ev.PS1())
+			return readLines(ev, stdin)
+		}
 	}
+	return readEvalLoop(cfg, ev, readCode, isTTY)
 }
 
-func repl(ev *eval.Evaler) {
-	stdin := bufio.NewReader(os.Stdin)
+// Reads code with readCode and evaluates it until EOF or the exit command.
+// The ignoreeof option is only honored when moreAfterEOF is true, which is
+// the case when reading from a terminal.
+func readEvalLoop(cfg *config, ev *eval.Evaler, readCode func() (string, error), moreAfterEOF bool) int {
+	status := 0
 	for {
-		fmt.Print("posixsh> ")
-		input, err := stdin.ReadString('\n')
-		if err != nil {
+		ev.ReportJobs()
+		code, err := readCode()
+		if code != "" {
+			ev.AddHistory(code)
+			status = evalCode(cfg, ev, code)
+		}
+		if ev.Exited() {
+			return status
+		}
+		if err == io.EOF && moreAfterEOF && ev.Option("ignoreeof") {
+			// Only terminals can have more input after EOF; ignoring EOF in
+			// other cases would result in an infinite loop.
+			fmt.Fprintln(os.Stderr, `Use "exit" to leave the shell.`)
+			continue
+		} else if err != nil {
 			if err != io.EOF {
-				fmt.Println(err)
+				fmt.Fprintln(os.Stderr, err)
 			}
 			break
 		}
-		doEval(ev, input)
 	}
+	return ev.RunExitTrap(status)
 }
 
-func evalAll(ev *eval.Evaler, r io.Reader) {
-	buf, err := io.ReadAll(r)
-	if err != nil {
-		fmt.Println(err)
+// Reads lines until they form complete code, prompting with $PS2 for each
+// continuation line.
+func readLines(ev *eval.Evaler, r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		sb.WriteString(line)
+		if err != nil || !parse.IsIncomplete(sb.String()) {
+			return sb.String(), err
+		}
+		fmt.Fprint(os.Stderr, ev.PS2())
 	}
-	doEval(ev, string(buf))
 }
 
-func doEval(ev *eval.Evaler, input string) {
-	n, err := parse.Parse(input)
-	if *printAST {
-		fmt.Println("node:", parse.PprintAST(n))
-	}
-	if err != nil {
-		fmt.Println("err:", err)
-		for _, entry := range err.(parse.Error).Errors {
-			sr := diag.NewContext("input", input, diag.PointRanging(entry.Position))
-			fmt.Printf("  %s\n", entry.Message)
-			fmt.Printf("    %s\n", sr.ShowCompact(""))
+func evalAll(cfg *config, ev *eval.Evaler, name string, r io.Reader) int {
+	cr := parse.NewReader(name, r, ev.Alias)
+	status := 0
+	syntaxError := false
+	for {
+		n, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if _, ok := err.(parse.Error); ok {
+			eval.PrintSyntaxErrors(os.Stderr, name, err)
+			status = eval.StatusSyntaxError
+			if ev.Option("noexec") {
+				// Keep checking the rest of the code, which is never executed
+				// in this case.
+				syntaxError = true
+				continue
+			}
+			break
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+			break
+		}
+		if cfg.printAST {
+			fmt.Println("node:", parse.PprintAST(n))
+		}
+		var ok bool
+		status, ok = ev.EvalChunk(n)
+		if !ok {
+			break
 		}
 	}
+	if syntaxError {
+		status = eval.StatusSyntaxError
+	}
+	return ev.RunExitTrap(status)
+}
 
-	status := ev.EvalChunk(n)
-	if status != 0 {
-		fmt.Println("status:", status)
+func evalCode(cfg *config, ev *eval.Evaler, code string) int {
+	if cfg.printAST {
+		n, _ := parse.Parse("", code)
+		fmt.Println("node:", parse.PprintAST(n))
 	}
+	return ev.Eval(code)
 }
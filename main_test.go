@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elves/posixsh/pkg/eval"
+	"github.com/google/go-cmp/cmp"
+)
+
+// When this environment variable is set, the test binary runs the shell
+// instead of the tests, with the remaining arguments as the argv of the shell.
+// This allows testing features that need a separate process, like signal
+// handling and startup files.
+const runShellEnv = "POSIXSH_TEST_RUN_SHELL"
+
+// The path of the file the shell sources in place of /etc/profile, so that
+// tests don't depend on the host.
+const systemProfileEnv = "POSIXSH_TEST_SYSTEM_PROFILE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runShellEnv) != "" {
+		eval.SystemProfile = os.Getenv(systemProfileEnv)
+		os.Exit(run(os.Args))
+	}
+	os.Exit(m.Run())
+}
+
+// Returns a command that runs the shell with the given argv. The environment
+// is that of the test plus env, which may also set the system profile.
+func shellCommand(argv []string, env ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Args = argv
+	cmd.Env = append(os.Environ(),
+		runShellEnv+"=1", systemProfileEnv+"=/nonexistent/profile")
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
+// Runs the shell with the given argv and stdin, and returns its stdout.
+func runShell(t *testing.T, stdin string, argv []string, env ...string) string {
+	t.Helper()
+	cmd := shellCommand(argv, env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Errorf("shell exited with %v", err)
+	}
+	return string(out)
+}
+
+var parseArgsTests = []struct {
+	name    string
+	args    []string
+	want    *config
+	wantErr string
+}{
+	{
+		name: "no arguments",
+		args: []string{},
+		want: &config{operands: []string{}},
+	},
+	{
+		name: "script and arguments",
+		args: []string{"script", "-e", "foo"},
+		want: &config{operands: []string{"script", "-e", "foo"}},
+	},
+	{
+		name: "-c with command name and arguments",
+		args: []string{"-c", "echo", "name", "foo"},
+		want: &config{command: true, operands: []string{"echo", "name", "foo"}},
+	},
+	{
+		name: "combined letters",
+		args: []string{"-eux", "+v", "-s", "foo"},
+		want: &config{stdin: true, operands: []string{"foo"}, options: []option{
+			{"errexit", true}, {"nounset", true}, {"xtrace", true}, {"verbose", false}}},
+	},
+	{
+		name: "-o and +o",
+		args: []string{"-o", "pipefail", "+o", "errexit", "script"},
+		want: &config{operands: []string{"script"},
+			options: []option{{"pipefail", true}, {"errexit", false}}},
+	},
+	{
+		name: "-i and -l",
+		args: []string{"-il", "+i"},
+		want: &config{interactive: true, login: true, operands: []string{}},
+	},
+	{
+		name: "-print-ast",
+		args: []string{"-print-ast", "script"},
+		want: &config{printAST: true, operands: []string{"script"}},
+	},
+	{
+		name: "-- and - end options",
+		args: []string{"-e", "--", "-x"},
+		want: &config{operands: []string{"-x"}, options: []option{{"errexit", true}}},
+	},
+	{
+		name:    "-o without argument",
+		args:    []string{"-o"},
+		wantErr: "-o requires an argument",
+	},
+	{
+		name:    "unknown option letter",
+		args:    []string{"-k"},
+		wantErr: "unknown option -k",
+	},
+	{
+		name:    "-c and -s",
+		args:    []string{"-c", "-s", "echo"},
+		wantErr: "-c and -s are mutually exclusive",
+	},
+}
+
+func TestParseArgs(t *testing.T) {
+	for _, test := range parseArgsTests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseArgs(test.args)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if diff := cmp.Diff(test.want, cfg, cmp.AllowUnexported(config{}, option{})); diff != "" {
+				t.Errorf("config (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+var runTests = []struct {
+	name       string
+	argv       []string
+	stdin      string
+	wantStdout string
+	wantStatus int
+}{
+	{
+		name:       "-c sets $0 and positional parameters",
+		argv:       []string{"posixsh", "-c", `echo "$0 $# $1 $2"`, "name", "foo", "bar"},
+		wantStdout: "name 2 foo bar\n",
+	},
+	{
+		name:       "-c without command name uses argv[0] as $0",
+		argv:       []string{"posixsh", "-c", `echo "$0 $#"`},
+		wantStdout: "posixsh 0\n",
+	},
+	{
+		name:       "-s reads commands from stdin with operands as positional parameters",
+		argv:       []string{"posixsh", "-s", "foo", "bar"},
+		stdin:      `echo "$# $1 $2"` + "\n",
+		wantStdout: "2 foo bar\n",
+	},
+	{
+		name:       "script receives arguments",
+		argv:       []string{"posixsh", "script.sh", "foo"},
+		wantStdout: "script.sh foo\n",
+	},
+	{
+		name:       "option letters are set",
+		argv:       []string{"posixsh", "-eu", "-c", `echo $-`},
+		wantStdout: "eu\n",
+	},
+	{
+		name:       "-o pipefail is set",
+		argv:       []string{"posixsh", "-o", "pipefail", "-c", "false | true"},
+		wantStatus: 1,
+	},
+	{
+		name:       "argv[0] starting with - makes a login shell",
+		argv:       []string{"-posixsh", "-c", "echo done"},
+		wantStdout: "profile\ndone\n",
+	},
+	{
+		name:       "exits with the status of the last command",
+		argv:       []string{"posixsh", "-c", "sh -c 'exit 3'"},
+		wantStatus: 3,
+	},
+	{
+		name:       "exits with the status passed to exit",
+		argv:       []string{"posixsh", "-s"},
+		stdin:      "exit 4\necho unreachable\n",
+		wantStatus: 4,
+	},
+	{
+		name:       "bad command line",
+		argv:       []string{"posixsh", "-k"},
+		wantStatus: 2,
+	},
+	{
+		name:       "nonexistent script",
+		argv:       []string{"posixsh", "nonexistent.sh"},
+		wantStatus: 127,
+	},
+}
+
+func TestRun(t *testing.T) {
+	for _, test := range runTests {
+		t.Run(test.name, func(t *testing.T) {
+			home := makeHome(t, map[string]string{
+				".profile":  "echo profile\n",
+				"script.sh": `echo "$0 $1"` + "\n",
+			})
+			cmd := shellCommand(test.argv, "HOME="+home)
+			cmd.Dir = home
+			cmd.Stdin = strings.NewReader(test.stdin)
+			stdout, err := cmd.Output()
+			status := 0
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				status = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if string(stdout) != test.wantStdout {
+				t.Errorf("got stdout %q, want %q", stdout, test.wantStdout)
+			}
+			if status != test.wantStatus {
+				t.Errorf("got status %v, want %v", status, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestInteractive_IgnoresNoexec(t *testing.T) {
+	out := runShell(t, "set -n\necho foo\nset +n\necho bar\n",
+		[]string{"posixsh", "-i"})
+	if want := "foo\nbar\n"; out != want {
+		t.Errorf("got stdout %q, want %q", out, want)
+	}
+}
+
+func TestNonInteractive_HonorsNoexec(t *testing.T) {
+	out := runShell(t, "set -n\necho foo\nset +n\necho bar\n",
+		[]string{"posixsh", "-s"})
+	if want := ""; out != want {
+		t.Errorf("got stdout %q, want %q", out, want)
+	}
+}
+
+func TestNoexec_ReportsAllSyntaxErrors(t *testing.T) {
+	home := makeHome(t, map[string]string{
+		"bad.sh": "echo a\necho )\necho b\nif true; done\nfor 1 in a; do :; done\n",
+	})
+	cmd := shellCommand([]string{"posixsh", "-n", "bad.sh"})
+	cmd.Dir = home
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 2 {
+		t.Errorf("got error %v, want exit status 2", err)
+	}
+	if len(stdout) != 0 {
+		t.Errorf("got stdout %q, want empty", stdout)
+	}
+	wantStderr := "bad.sh:2:6: syntax error: unparsed code\n" +
+		"bad.sh:4:10: syntax error: unexpected keyword \"done\"\n" +
+		"bad.sh:5:5: syntax error: invalid variable name \"1\"\n"
+	if stderr.String() != wantStderr {
+		t.Errorf("got stderr %q, want %q", stderr.String(), wantStderr)
+	}
+}
+
+// Creates files in a temporary directory, and returns the directory.
+func makeHome(t *testing.T, files map[string]string) string {
+	t.Helper()
+	home := t.TempDir()
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(home, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return home
+}
+
+var startupTests = []struct {
+	name string
+	argv []string
+	env  string
+	want string
+}{
+	{
+		name: "interactive shell sources the file named by expanded ENV",
+		argv: []string{"posixsh", "-i"},
+		env:  "$HOME/env.sh",
+		want: "env\ndone\n",
+	},
+	{
+		name: "non-interactive shell doesn't source ENV",
+		argv: []string{"posixsh", "-s"},
+		env:  "$HOME/env.sh",
+		want: "done\n",
+	},
+	{
+		name: "login shell sources the system profile and .profile",
+		argv: []string{"-posixsh", "-s"},
+		want: "system profile\nprofile\ndone\n",
+	},
+	{
+		name: "interactive login shell sources the profiles before ENV",
+		argv: []string{"posixsh", "-l", "-i"},
+		want: "system profile\nprofile\nenv\ndone\n",
+	},
+	{
+		name: "$- contains i in interactive shells",
+		argv: []string{"posixsh", "-i"},
+		env:  "$HOME/interactive.sh",
+		want: "interactive\ndone\n",
+	},
+}
+
+func TestStartup(t *testing.T) {
+	for _, test := range startupTests {
+		t.Run(test.name, func(t *testing.T) {
+			home := makeHome(t, map[string]string{
+				"system-profile": "echo system profile\n",
+				".profile":       "echo profile\nENV=\"$HOME/env.sh\"\n",
+				"env.sh":         "echo env\n",
+				"interactive.sh": "case $- in *i*) echo interactive; esac\n",
+			})
+			out := runShell(t, "echo done\n", test.argv, "HOME="+home,
+				"ENV="+test.env, systemProfileEnv+"="+home+"/system-profile")
+			if out != test.want {
+				t.Errorf("got stdout %q, want %q", out, test.want)
+			}
+		})
+	}
+}
+
+func TestInteractive_SurvivesSignals(t *testing.T) {
+	cmd := shellCommand([]string{"posixsh", "-i"})
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stdin, "echo started; while :; do :; done; echo not reached\n")
+	r := bufio.NewReader(stdout)
+	if line, _ := r.ReadString('\n'); line != "started\n" {
+		t.Fatalf("got line %q, want %q", line, "started\n")
+	}
+	// SIGTERM and SIGQUIT are ignored, and SIGINT interrupts the loop.
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT} {
+		time.Sleep(10 * time.Millisecond)
+		cmd.Process.Signal(sig)
+	}
+	io.WriteString(stdin, "echo alive $?\n")
+	stdin.Close()
+	rest, _ := io.ReadAll(r)
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("shell exited with %v", err)
+	}
+	if want := "alive 130\n"; string(rest) != want {
+		t.Errorf("got stdout %q, want %q", rest, want)
+	}
+}
+
+type readResult struct {
+	code string
+	err  error
+}
+
+var readEvalLoopIgnoreEOFTests = []struct {
+	name         string
+	ignoreeof    bool
+	moreAfterEOF bool
+	wantStatus   int
+	wantStdout   string
+	wantReads    int
+}{
+	{"EOF exits", false, true, 0, "", 1},
+	{"ignoreeof ignores EOF", true, true, 3, "foo\n", 4},
+	{"ignoreeof needs more input after EOF", true, false, 0, "", 1},
+}
+
+func TestReadEvalLoop_IgnoreEOF(t *testing.T) {
+	for _, test := range readEvalLoopIgnoreEOFTests {
+		t.Run(test.name, func(t *testing.T) {
+			results := []readResult{
+				{"", io.EOF}, {"echo foo\n", nil}, {"", io.EOF}, {"exit 3\n", nil},
+			}
+			reads := 0
+			readCode := func() (string, error) {
+				res := results[reads]
+				reads++
+				return res.code, res.err
+			}
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev := eval.NewEvaler([]string{"posixsh"}, []*os.File{os.Stdin, w, os.Stderr})
+			ev.SetOption("ignoreeof", test.ignoreeof)
+
+			status := readEvalLoop(&config{}, ev, readCode, test.moreAfterEOF)
+			w.Close()
+			stdout, _ := io.ReadAll(r)
+			if status != test.wantStatus {
+				t.Errorf("got status %v, want %v", status, test.wantStatus)
+			}
+			if string(stdout) != test.wantStdout {
+				t.Errorf("got stdout %q, want %q", stdout, test.wantStdout)
+			}
+			if reads != test.wantReads {
+				t.Errorf("got %v reads, want %v", reads, test.wantReads)
+			}
+		})
+	}
+}
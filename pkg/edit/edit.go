@@ -0,0 +1,409 @@
+// Package edit implements the line editor of interactive shells, built on top
+// of Elvish's cli packages.
+package edit
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/elves/posixsh/pkg/parse"
+	"src.elv.sh/pkg/cli"
+	"src.elv.sh/pkg/cli/histutil"
+	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/cli/tk"
+	"src.elv.sh/pkg/ui"
+)
+
+// Spec specifies the configuration of an Editor.
+type Spec struct {
+	// The terminal to read from and draw on.
+	TTY cli.TTY
+	// Called at the start of each ReadCode to get the prompt, usually the
+	// value of $PS1.
+	Prompt func() string
+	// Called at the start of each ReadCode to decide whether to use vi key
+	// bindings instead of emacs ones, usually from "set -o vi".
+	Vi func() bool
+	// Called at the start of each ReadCode to get the commands to recall with
+	// history navigation, oldest first.
+	History func() []string
+}
+
+// Editor reads commands from a terminal, with the ability to edit them.
+type Editor struct {
+	spec Spec
+	app  cli.App
+
+	// Commands to recall in the current ReadCode.
+	history histutil.Store
+	// Whether vi key bindings are used for the current ReadCode.
+	vi bool
+	// Whether the vi key bindings are in command mode rather than insert mode.
+	command bool
+	// Cursor for history navigation, and the content of the buffer before
+	// history navigation started. The cursor is nil when not navigating.
+	cursor histutil.Cursor
+	saved  string
+}
+
+// New creates a new Editor.
+func New(spec Spec) *Editor {
+	if spec.TTY == nil {
+		spec.TTY = cli.NewTTY(nil, nil)
+	}
+	if spec.Prompt == nil {
+		spec.Prompt = func() string { return "" }
+	}
+	if spec.Vi == nil {
+		spec.Vi = func() bool { return false }
+	}
+	if spec.History == nil {
+		spec.History = func() []string { return nil }
+	}
+	return &Editor{spec: spec}
+}
+
+// ReadCode reads one or more complete commands from the terminal. Pressing
+// Enter when the code is still incomplete - for example, when a quote or a
+// compound command is unclosed - inserts a newline instead, so commands
+// spanning multiple lines can be edited as a whole.
+//
+// It returns io.EOF when Ctrl-D is pressed on an empty line, or the terminal is
+// hung up. Ctrl-C discards what has been entered and starts over.
+func (ed *Editor) ReadCode() (string, error) {
+	ed.history = histutil.NewMemStore(ed.spec.History()...)
+	ed.vi, ed.command = ed.spec.Vi(), false
+	ed.cursor, ed.saved = nil, ""
+	ed.app = cli.NewApp(cli.AppSpec{
+		TTY:              ed.spec.TTY,
+		Prompt:           cli.NewConstPrompt(ui.T(ed.spec.Prompt())),
+		CodeAreaBindings: tk.FuncBindings(ed.handle),
+	})
+	code, err := ed.app.ReadCode()
+	if err == nil {
+		// The code area never includes the final newline.
+		code += "\n"
+	}
+	return code, err
+}
+
+func (ed *Editor) handle(w tk.Widget, e term.Event) bool {
+	k, ok := e.(term.KeyEvent)
+	if !ok {
+		return false
+	}
+	c := w.(tk.CodeArea)
+	key := ui.Key(k)
+	if ed.vi && ed.command {
+		return ed.handleViCommand(c, key)
+	}
+	return ed.handleInsert(c, key)
+}
+
+// Handles keys when not in vi command mode. Keys that are not handled here are
+// handled by the code area itself, which inserts printable characters and
+// supports Backspace and Enter.
+func (ed *Editor) handleInsert(c tk.CodeArea, key ui.Key) bool {
+	switch key {
+	case ui.K(ui.Enter):
+		if !incomplete(c) {
+			return false
+		}
+		mutate(c, func(b *tk.CodeBuffer) { b.InsertAtDot("\n") })
+	case ui.K('D', ui.Ctrl):
+		if c.CopyState().Buffer.Content == "" {
+			ed.app.CommitEOF()
+		} else {
+			mutate(c, deleteRight)
+		}
+	case ui.K(ui.Left):
+		mutate(c, moveLeft)
+	case ui.K(ui.Right):
+		mutate(c, moveRight)
+	case ui.K(ui.Home):
+		mutate(c, moveStartOfLine)
+	case ui.K(ui.End):
+		mutate(c, moveEndOfLine)
+	case ui.K(ui.Delete):
+		mutate(c, deleteRight)
+	case ui.K(ui.Up):
+		ed.historyPrev(c)
+	case ui.K(ui.Down):
+		ed.historyNext(c)
+	case ui.K('[', ui.Ctrl): // Esc
+		if !ed.vi {
+			return false
+		}
+		ed.command = true
+		mutate(c, moveLeftInLine)
+	default:
+		if ed.vi {
+			return ed.handleViInsert(c, key)
+		}
+		return ed.handleEmacs(c, key)
+	}
+	return true
+}
+
+func (ed *Editor) handleEmacs(c tk.CodeArea, key ui.Key) bool {
+	switch key {
+	case ui.K('A', ui.Ctrl):
+		mutate(c, moveStartOfLine)
+	case ui.K('E', ui.Ctrl):
+		mutate(c, moveEndOfLine)
+	case ui.K('B', ui.Ctrl):
+		mutate(c, moveLeft)
+	case ui.K('F', ui.Ctrl):
+		mutate(c, moveRight)
+	case ui.K('b', ui.Alt):
+		mutate(c, moveWordLeft)
+	case ui.K('f', ui.Alt):
+		mutate(c, moveWordRight)
+	case ui.K('P', ui.Ctrl):
+		ed.historyPrev(c)
+	case ui.K('N', ui.Ctrl):
+		ed.historyNext(c)
+	case ui.K('K', ui.Ctrl):
+		mutate(c, killEndOfLine)
+	case ui.K('U', ui.Ctrl):
+		mutate(c, killStartOfLine)
+	case ui.K('W', ui.Ctrl):
+		mutate(c, killWordLeft)
+	default:
+		return false
+	}
+	return true
+}
+
+// Handles keys in vi insert mode that are not shared with emacs mode. Like in
+// other shells, a few control keys work too.
+func (ed *Editor) handleViInsert(c tk.CodeArea, key ui.Key) bool {
+	switch key {
+	case ui.K('U', ui.Ctrl):
+		mutate(c, killStartOfLine)
+	case ui.K('W', ui.Ctrl):
+		mutate(c, killWordLeft)
+	default:
+		return false
+	}
+	return true
+}
+
+func (ed *Editor) handleViCommand(c tk.CodeArea, key ui.Key) bool {
+	insert := func(f func(*tk.CodeBuffer)) {
+		mutate(c, f)
+		ed.command = false
+	}
+	switch key {
+	case ui.K(ui.Enter):
+		if incomplete(c) {
+			insert(func(b *tk.CodeBuffer) {
+				b.Dot = len(b.Content)
+				b.InsertAtDot("\n")
+			})
+		} else {
+			ed.app.CommitCode()
+		}
+	case ui.K('D', ui.Ctrl):
+		if c.CopyState().Buffer.Content == "" {
+			ed.app.CommitEOF()
+		}
+	case ui.K('h'), ui.K(ui.Left), ui.K(ui.Backspace):
+		mutate(c, moveLeftInLine)
+	case ui.K('l'), ui.K(ui.Right), ui.K(' '):
+		mutate(c, moveRightInLine)
+	case ui.K('0'), ui.K('^'), ui.K(ui.Home):
+		mutate(c, moveStartOfLine)
+	case ui.K('$'), ui.K(ui.End):
+		mutate(c, func(b *tk.CodeBuffer) {
+			moveEndOfLine(b)
+			moveLeftInLine(b)
+		})
+	case ui.K('w'):
+		mutate(c, moveWordRight)
+	case ui.K('b'):
+		mutate(c, moveWordLeft)
+	case ui.K('k'), ui.K('-'), ui.K(ui.Up):
+		ed.historyPrev(c)
+	case ui.K('j'), ui.K('+'), ui.K(ui.Down):
+		ed.historyNext(c)
+	case ui.K('x'), ui.K(ui.Delete):
+		mutate(c, func(b *tk.CodeBuffer) {
+			if b.Dot < len(b.Content) && b.Content[b.Dot] != '\n' {
+				deleteRight(b)
+			}
+		})
+	case ui.K('X'):
+		mutate(c, func(b *tk.CodeBuffer) {
+			if b.Dot > 0 && b.Content[b.Dot-1] != '\n' {
+				deleteLeft(b)
+			}
+		})
+	case ui.K('D'):
+		mutate(c, killEndOfLine)
+	case ui.K('i'):
+		insert(func(*tk.CodeBuffer) {})
+	case ui.K('a'):
+		insert(moveRightInLine)
+	case ui.K('I'):
+		insert(moveStartOfLine)
+	case ui.K('A'):
+		insert(moveEndOfLine)
+	case ui.K('C'):
+		insert(killEndOfLine)
+	case ui.K('S'):
+		insert(func(b *tk.CodeBuffer) {
+			moveStartOfLine(b)
+			killEndOfLine(b)
+		})
+	}
+	// All other keys are ignored in command mode, instead of being inserted.
+	return true
+}
+
+// Replaces the buffer with the previous command in the history. The content
+// of the buffer before history navigation is saved, and restored when
+// navigating past the newest command.
+func (ed *Editor) historyPrev(c tk.CodeArea) {
+	if ed.cursor == nil {
+		ed.cursor = histutil.NewDedupCursor(ed.history.Cursor(""))
+		ed.saved = c.CopyState().Buffer.Content
+	}
+	ed.cursor.Prev()
+	cmd, err := ed.cursor.Get()
+	if err != nil {
+		ed.cursor.Next()
+		return
+	}
+	setContent(c, cmd.Text)
+}
+
+func (ed *Editor) historyNext(c tk.CodeArea) {
+	if ed.cursor == nil {
+		return
+	}
+	ed.cursor.Next()
+	cmd, err := ed.cursor.Get()
+	if err != nil {
+		setContent(c, ed.saved)
+		ed.cursor, ed.saved = nil, ""
+		return
+	}
+	setContent(c, cmd.Text)
+}
+
+// Returns whether the code in the buffer needs more lines to be complete. The
+// buffer doesn't contain the newline that Enter would add, so add it here.
+func incomplete(c tk.CodeArea) bool {
+	return parse.IsIncomplete(c.CopyState().Buffer.Content + "\n")
+}
+
+func setContent(c tk.CodeArea, content string) {
+	mutate(c, func(b *tk.CodeBuffer) {
+		*b = tk.CodeBuffer{Content: content, Dot: len(content)}
+	})
+}
+
+func mutate(c tk.CodeArea, f func(*tk.CodeBuffer)) {
+	c.MutateState(func(s *tk.CodeAreaState) { f(&s.Buffer) })
+}
+
+func moveLeft(b *tk.CodeBuffer) {
+	_, n := utf8.DecodeLastRuneInString(b.Content[:b.Dot])
+	b.Dot -= n
+}
+
+func moveRight(b *tk.CodeBuffer) {
+	_, n := utf8.DecodeRuneInString(b.Content[b.Dot:])
+	b.Dot += n
+}
+
+// Like moveLeft and moveRight, but don't move across newlines. Used in vi
+// command mode.
+
+func moveLeftInLine(b *tk.CodeBuffer) {
+	if b.Dot > 0 && b.Content[b.Dot-1] != '\n' {
+		moveLeft(b)
+	}
+}
+
+func moveRightInLine(b *tk.CodeBuffer) {
+	if b.Dot < len(b.Content) && b.Content[b.Dot] != '\n' {
+		moveRight(b)
+	}
+}
+
+func moveStartOfLine(b *tk.CodeBuffer) {
+	b.Dot = startOfLine(b)
+}
+
+func moveEndOfLine(b *tk.CodeBuffer) {
+	b.Dot = endOfLine(b)
+}
+
+// Words are sequences of non-whitespace characters, like "WORD" in vi.
+
+func moveWordLeft(b *tk.CodeBuffer) {
+	b.Dot = wordLeft(b)
+}
+
+func moveWordRight(b *tk.CodeBuffer) {
+	rest := b.Content[b.Dot:]
+	i := strings.IndexFunc(rest, unicode.IsSpace)
+	if i == -1 {
+		b.Dot = len(b.Content)
+		return
+	}
+	j := strings.IndexFunc(rest[i:], isNotSpace)
+	if j == -1 {
+		b.Dot = len(b.Content)
+		return
+	}
+	b.Dot += i + j
+}
+
+func deleteLeft(b *tk.CodeBuffer) {
+	dot := b.Dot
+	moveLeft(b)
+	b.Content = b.Content[:b.Dot] + b.Content[dot:]
+}
+
+func deleteRight(b *tk.CodeBuffer) {
+	_, n := utf8.DecodeRuneInString(b.Content[b.Dot:])
+	b.Content = b.Content[:b.Dot] + b.Content[b.Dot+n:]
+}
+
+func killStartOfLine(b *tk.CodeBuffer) {
+	start := startOfLine(b)
+	b.Content = b.Content[:start] + b.Content[b.Dot:]
+	b.Dot = start
+}
+
+func killEndOfLine(b *tk.CodeBuffer) {
+	b.Content = b.Content[:b.Dot] + b.Content[endOfLine(b):]
+}
+
+func killWordLeft(b *tk.CodeBuffer) {
+	start := wordLeft(b)
+	b.Content = b.Content[:start] + b.Content[b.Dot:]
+	b.Dot = start
+}
+
+func startOfLine(b *tk.CodeBuffer) int {
+	return strings.LastIndexByte(b.Content[:b.Dot], '\n') + 1
+}
+
+func endOfLine(b *tk.CodeBuffer) int {
+	if i := strings.IndexByte(b.Content[b.Dot:], '\n'); i != -1 {
+		return b.Dot + i
+	}
+	return len(b.Content)
+}
+
+func wordLeft(b *tk.CodeBuffer) int {
+	before := strings.TrimRightFunc(b.Content[:b.Dot], unicode.IsSpace)
+	return strings.LastIndexFunc(before, unicode.IsSpace) + 1
+}
+
+func isNotSpace(r rune) bool { return !unicode.IsSpace(r) }
@@ -0,0 +1,132 @@
+package edit
+
+import (
+	"io"
+	"syscall"
+	"testing"
+
+	"src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/ui"
+)
+
+var readCodeTests = []struct {
+	name    string
+	vi      bool
+	history []string
+	events  []term.Event
+	want    string
+}{
+	{
+		name:   "plain line",
+		events: keys("echo foo", ui.Enter),
+		want:   "echo foo\n",
+	},
+	{
+		name:   "Enter inserts newline in incomplete code",
+		events: keys("for x in a; do", ui.Enter, "echo $x", ui.Enter, "done", ui.Enter),
+		want:   "for x in a; do\necho $x\ndone\n",
+	},
+	{
+		name:   "cursor movement",
+		events: keys("echo bar", ui.Home, "x", ui.End, "y", ui.Left, "z", ui.Enter),
+		want:   "xecho barzy\n",
+	},
+	{
+		name: "emacs bindings",
+		events: keys("echo foo bar", ui.K('W', ui.Ctrl), ui.K('A', ui.Ctrl),
+			ui.K('f', ui.Alt), "x ", ui.K('E', ui.Ctrl), "y", ui.Enter),
+		want: "echo x foo y\n",
+	},
+	{
+		name:    "history navigation",
+		history: []string{"echo 1", "echo 2", "echo 2"},
+		events:  keys("new", ui.Up, ui.Up, ui.Enter),
+		want:    "echo 1\n",
+	},
+	{
+		name:    "history navigation restores the buffer",
+		history: []string{"echo 1"},
+		events:  keys("new", ui.Up, ui.Down, ui.Enter),
+		want:    "new\n",
+	},
+	{
+		name:   "vi command mode",
+		vi:     true,
+		events: keys("echo foo", ui.K('[', ui.Ctrl), "hxA!", ui.Enter),
+		want:   "echo fo!\n",
+	},
+	{
+		name:    "vi history navigation",
+		vi:      true,
+		history: []string{"echo 1"},
+		events:  keys(ui.K('[', ui.Ctrl), "kA2", ui.Enter),
+		want:    "echo 12\n",
+	},
+}
+
+func TestReadCode(t *testing.T) {
+	for _, test := range readCodeTests {
+		t.Run(test.name, func(t *testing.T) {
+			tty, ttyCtrl := clitest.NewFakeTTY()
+			ed := New(Spec{
+				TTY:     tty,
+				Vi:      func() bool { return test.vi },
+				History: func() []string { return test.history },
+			})
+			ttyCtrl.Inject(test.events...)
+			code, err := ed.ReadCode()
+			if code != test.want || err != nil {
+				t.Errorf("got (%q, %v), want (%q, nil)", code, err, test.want)
+			}
+		})
+	}
+}
+
+func TestReadCode_CtrlDOnEmptyLine(t *testing.T) {
+	tty, ttyCtrl := clitest.NewFakeTTY()
+	ed := New(Spec{TTY: tty})
+	ttyCtrl.Inject(keys(ui.K('D', ui.Ctrl))...)
+	_, err := ed.ReadCode()
+	if err != io.EOF {
+		t.Errorf("got error %v, want io.EOF", err)
+	}
+}
+
+func TestReadCode_CtrlCCancelsLine(t *testing.T) {
+	tty, ttyCtrl := clitest.NewFakeTTY()
+	ed := New(Spec{TTY: tty, Prompt: func() string { return "> " }})
+	codeCh, errCh := clitest.StartReadCode(ed.ReadCode)
+	_, width := tty.Size()
+
+	ttyCtrl.Inject(keys("echo foo")...)
+	ttyCtrl.TestBuffer(t, term.NewBufferBuilder(width).
+		Write("> echo foo").SetDotHere().Buffer())
+	ttyCtrl.InjectSignal(syscall.SIGINT)
+	ttyCtrl.TestBuffer(t, term.NewBufferBuilder(width).
+		Write("> ").SetDotHere().Buffer())
+	ttyCtrl.Inject(keys("echo bar", ui.Enter)...)
+
+	if code, err := <-codeCh, <-errCh; code != "echo bar\n" || err != nil {
+		t.Errorf("got (%q, %v), want (%q, nil)", code, err, "echo bar\n")
+	}
+}
+
+// Converts strings and keys to key events. Strings are converted to one event
+// for each rune.
+func keys(args ...any) []term.Event {
+	var events []term.Event
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			for _, r := range arg {
+				events = append(events, term.K(r))
+			}
+		case rune:
+			events = append(events, term.K(arg))
+		case ui.Key:
+			events = append(events, term.KeyEvent(arg))
+		}
+	}
+	return events
+}
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/elves/posixsh/pkg/parse"
 	"golang.org/x/sys/unix"
 )
 
@@ -17,16 +18,16 @@ var builtins = map[string]func(*frame, []string) int{
 	"bg":    bgCmd,
 	"cd":    cdCmd,
 	// command is added in init
-	"false":   falseCmd,
-	"fc":      fcCmd,
+	"false": falseCmd,
+	// fc is in abortingBuiltins
 	"fg":      fgCmd,
 	"getopts": getoptsCmd,
-	"hash":    hashCmd,
-	"jobs":    jobsCmd,
+	// hash is added in init
+	"jobs": jobsCmd,
 	// kill and newgrp are omitted; they are usually available as external
 	// commands.
-	"pwd":  pwdCmd,
-	"read": readCmd,
+	"pwd": pwdCmd,
+	// read is added in init
 	"true": trueCmd,
 	// type is added in init
 	"ulimit":  ulimitCmd,
@@ -35,23 +36,23 @@ var builtins = map[string]func(*frame, []string) int{
 	"wait":    waitCmd,
 }
 
+// Regular builtins that run code, and can abort the evaluation like special
+// builtins, for example when the code calls exit.
+var abortingBuiltins = map[string]func(*frame, []string) (int, bool){
+	// fc is added in init
+}
+
 func init() {
 	// Some commands are added in the map here to avoid dependency cycles.
 	builtins["command"] = commandCmd
+	abortingBuiltins["fc"] = fcCmd
+	builtins["hash"] = hashCmd
+	builtins["read"] = readCmd
 	builtins["type"] = typeCmd
 }
 
-// Limitation: the alias substitution mechanism specified by POSIX requires the
-// results to participate in the grammar of the command. For example, the
-// following is valid:
-//
-//	alias x='echo x; echo'
-//	x bar # equivalent to: echo x; echo bar
-//
-// This is particularly difficult for this implementation as most of the parsing
-// happens statically without the knowledge of the alias table. Instead, we only
-// definitions that consist of barewords and returns an error when there is
-// anything more complex.
+// Alias substitution itself is performed by the parser, which looks up the
+// alias table while parsing each complete command; see the parse package.
 func aliasCmd(fm *frame, args []string) int {
 	if len(args) == 0 {
 		printAliases(fm)
@@ -73,12 +74,7 @@ func aliasCmd(fm *frame, args []string) int {
 				status = 1
 				continue
 			}
-			if aliasSupported(def) {
-				fm.aliases[name] = def
-			} else {
-				fmt.Fprintf(fm.files[2], "alias definitions with metacharacters are not supported: %v", def)
-				status = 1
-			}
+			fm.aliases[name] = def
 		} else {
 			if _, ok := fm.aliases[name]; ok {
 				printAlias(fm, name)
@@ -107,8 +103,44 @@ func printAlias(fm *frame, name string) {
 }
 
 func bgCmd(fm *frame, args []string) int {
-	// TODO
-	return 0
+	jobs, status := findJobsForJobControl(fm, args)
+	for _, j := range jobs {
+		if j.finished() {
+			fmt.Fprintf(fm.files[2], "job %v has already finished\n", j.number)
+			status = 1
+			continue
+		}
+		j.resume(false)
+		// Format specified by POSIX.
+		fmt.Fprintf(fm.files[1], "[%d] %s\n", j.number, j.text)
+	}
+	return status
+}
+
+// Finds jobs for fg and bg. If args is empty, the current job is used.
+func findJobsForJobControl(fm *frame, args []string) ([]*job, int) {
+	if !fm.options.has(monitor) {
+		fmt.Fprintln(fm.files[2], "job control is not enabled")
+		return nil, 1
+	}
+	if len(args) == 0 {
+		args = []string{"%+"}
+	}
+	var jobs []*job
+	status := 0
+	for _, arg := range args {
+		j, err := fm.jobs.find(arg)
+		if err != nil {
+			fm.badCommandLine("%v", err)
+			return nil, StatusBadCommandLine
+		} else if j == nil {
+			fmt.Fprintf(fm.files[2], "no such job: %v\n", arg)
+			status = 1
+		} else {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, status
 }
 
 const pathSep = string(filepath.Separator)
@@ -250,7 +282,7 @@ func identifyCommandType(fm *frame, name, path string) int {
 		what = "a special builtin"
 	} else if _, ok := fm.functions[name]; ok {
 		what = "a function"
-	} else if _, ok := builtins[name]; ok {
+	} else if isRegularBuiltin(name) {
 		what = "a builtin"
 	} else {
 		path, status := fm.lookExecutable(name, path)
@@ -274,7 +306,7 @@ func expandCommand(fm *frame, name, path string) int {
 		what = name
 	} else if _, ok := fm.functions[name]; ok {
 		what = name
-	} else if _, ok := builtins[name]; ok {
+	} else if isRegularBuiltin(name) {
 		what = name
 	} else {
 		path, status := fm.lookExecutable(name, path)
@@ -298,28 +330,463 @@ func isShellKeyword(name string) bool {
 
 func falseCmd(*frame, []string) int { return 1 }
 
-func fcCmd(fm *frame, args []string) int {
-	// TODO
-	return 0
+func fcCmd(fm *frame, args []string) (int, bool) {
+	// Operands can be negative numbers like -1, which would be mistaken as
+	// options, so only parse options before the first of them.
+	split := len(args)
+	for i, arg := range args {
+		if _, err := strconv.Atoi(arg); err == nil && arg[0] == '-' {
+			split = i
+			break
+		}
+	}
+	opts, operands, err := getopts(args[:split], "e:lnrs")
+	if err != nil {
+		fm.badCommandLine("%v", err)
+		return StatusBadCommandLine, true
+	}
+	operands = append(operands, args[split:]...)
+
+	fm.loadHistory()
+	h := fm.history
+	entries := h.entries
+	if h.current {
+		entries = entries[:len(entries)-1]
+	}
+
+	if opts.has('s') {
+		if opts.has('l') || opts.has('e') {
+			fm.badCommandLine("-s can't be used with -l or -e")
+			return StatusBadCommandLine, true
+		}
+		var old, new string
+		if len(operands) > 0 && strings.Contains(operands[0], "=") {
+			old, new, _ = strings.Cut(operands[0], "=")
+			operands = operands[1:]
+		}
+		if len(operands) > 1 {
+			fm.badCommandLine("fc -s accepts at most one command")
+			return StatusBadCommandLine, true
+		}
+		first := "-1"
+		if len(operands) == 1 {
+			first = operands[0]
+		}
+		if len(entries) == 0 {
+			fm.diagCommand("history is empty")
+			return 1, true
+		}
+		i, ok := findHistory(fm, entries, first)
+		if !ok {
+			return 1, true
+		}
+		code := entries[i]
+		if old != "" {
+			code = strings.Replace(code, old, new, 1)
+		}
+		return fcRun(fm, code)
+	}
+
+	if len(operands) > 2 {
+		fm.badCommandLine("fc accepts at most two commands")
+		return StatusBadCommandLine, true
+	}
+	// The defaults are specified by POSIX.
+	var first, last string
+	if opts.has('l') {
+		first, last = "-16", "-1"
+	} else {
+		first, last = "-1", ""
+	}
+	if len(operands) > 0 {
+		first, last = operands[0], ""
+	}
+	if len(operands) > 1 {
+		last = operands[1]
+	}
+	if last == "" {
+		if opts.has('l') {
+			last = "-1"
+		} else {
+			last = first
+		}
+	}
+	if len(entries) == 0 {
+		if opts.has('l') {
+			return 0, true
+		}
+		fm.diagCommand("history is empty")
+		return 1, true
+	}
+	from, ok := findHistory(fm, entries, first)
+	if !ok {
+		return 1, true
+	}
+	to, ok := findHistory(fm, entries, last)
+	if !ok {
+		return 1, true
+	}
+	// POSIX requires the commands to be in reverse order when first is newer
+	// than last, and -r reverses the order again.
+	var selected []int
+	for i := from; ; {
+		selected = append(selected, i)
+		if i == to {
+			break
+		} else if i < to {
+			i++
+		} else {
+			i--
+		}
+	}
+	if opts.has('r') {
+		for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+			selected[i], selected[j] = selected[j], selected[i]
+		}
+	}
+
+	if opts.has('l') {
+		for _, i := range selected {
+			// Format specified by POSIX. Continuation lines of commands are
+			// indented, like in ksh.
+			code := strings.ReplaceAll(entries[i], "\n", "\n\t")
+			if opts.has('n') {
+				fmt.Fprintf(fm.files[1], "\t%s\n", code)
+			} else {
+				fmt.Fprintf(fm.files[1], "%d\t%s\n", h.first+i, code)
+			}
+		}
+		return 0, true
+	}
+
+	var sb strings.Builder
+	for _, i := range selected {
+		sb.WriteString(entries[i] + "\n")
+	}
+	f, err := os.CreateTemp("", "fc")
+	if err != nil {
+		fm.diagCommand("cannot create temporary file: %v", err)
+		return 1, true
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(sb.String())
+	f.Close()
+	if err != nil {
+		fm.diagCommand("cannot write temporary file: %v", err)
+		return 1, true
+	}
+	editor, ok := opts.get('e')
+	if !ok {
+		// POSIX specifies ed as the fallback.
+		editor = fm.getVarOr("FCEDIT", "ed")
+	}
+	// Like bash and ksh, the editor is subject to field splitting, so that it
+	// can contain arguments.
+	n, err := parse.Parse("fc", editor+" "+quote(f.Name()))
+	if err != nil {
+		PrintSyntaxErrors(fm.diagFile, "fc", err)
+		return StatusSyntaxError, true
+	}
+	if status, ok := fm.chunk(n); status != 0 || !ok {
+		return status, ok
+	}
+	bs, err := os.ReadFile(f.Name())
+	if err != nil {
+		fm.diagCommand("cannot read temporary file: %v", err)
+		return 1, true
+	}
+	return fcRun(fm, string(bs))
+}
+
+// Finds the command in entries identified by spec, a command number, a
+// negative offset from the end of the history, or a prefix of the command.
+// Numbers out of range are clamped, as required by POSIX.
+func findHistory(fm *frame, entries []string, spec string) (int, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		i := n - fm.history.first
+		if n < 0 {
+			i = len(entries) + n
+		} else if n == 0 {
+			// POSIX leaves 0 unspecified; like bash, treat it as -1.
+			i = len(entries) - 1
+		}
+		if i < 0 {
+			i = 0
+		} else if i >= len(entries) {
+			i = len(entries) - 1
+		}
+		return i, true
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if strings.HasPrefix(entries[i], spec) {
+			return i, true
+		}
+	}
+	fm.diagCommand("no command found: %v", spec)
+	return 0, false
+}
+
+// Runs code generated by fc. Like bash and ksh, the code is written to stdout
+// first, and replaces the fc command in the history.
+func fcRun(fm *frame, code string) (int, bool) {
+	if !strings.HasSuffix(code, "\n") {
+		code += "\n"
+	}
+	fmt.Fprint(fm.files[1], code)
+	fm.replaceCurrentHistory(code)
+	n, err := parse.ParseWithAliases("fc", code, fm.alias)
+	if err != nil {
+		PrintSyntaxErrors(fm.diagFile, "fc", err)
+		return StatusSyntaxError, true
+	}
+	return fm.chunk(n)
 }
 
 func fgCmd(fm *frame, args []string) int {
-	// TODO
-	return 0
+	if len(args) > 1 {
+		fm.badCommandLine("fg accepts at most one argument")
+		return StatusBadCommandLine
+	}
+	jobs, status := findJobsForJobControl(fm, args)
+	if len(jobs) == 0 {
+		return status
+	}
+	j := jobs[0]
+	// Format specified by POSIX.
+	fmt.Fprintln(fm.files[1], j.text)
+	j.resume(true)
+	defer reclaimTerminal()
+	select {
+	case <-j.done:
+		fm.jobs.remove(j)
+		return j.status
+	case <-j.stopCh:
+		j.mu.Lock()
+		j.foreground = false
+		sig := j.stopSignal
+		j.mu.Unlock()
+		cur, prev := fm.jobs.currentAndPrevious()
+		fmt.Fprint(fm.diagFile, formatJob(j, cur, prev, false))
+		return StatusSignalBase + int(sig)
+	}
+}
+
+// State of the getopts command that is not stored in variables.
+type getoptsState struct {
+	// Offset of the next option character within the argument $OPTIND points
+	// to, or 0 if parsing should start with a new argument. This is needed for
+	// arguments like "-abc" that contain multiple options.
+	//
+	// Reset whenever $OPTIND is assigned, so that parsing restarts from the
+	// argument it points to.
+	offset int
 }
 
 func getoptsCmd(fm *frame, args []string) int {
-	// TODO
-	return 0
+	if len(args) < 2 {
+		fm.badCommandLine("getopts requires at least 2 arguments")
+		return StatusBadCommandLine
+	}
+	optstring, name, args := args[0], args[1], args[2:]
+	if len(args) == 0 {
+		args = fm.arguments[1:]
+	}
+	silent := strings.HasPrefix(optstring, ":")
+	if silent {
+		optstring = optstring[1:]
+	}
+
+	// POSIX leaves the behavior unspecified when $OPTIND is invalid; we treat
+	// it like 1.
+	optind, err := strconv.Atoi(fm.getVar("OPTIND"))
+	if err != nil || optind < 1 {
+		optind = 1
+	}
+	offset := fm.getoptsState.offset
+
+	setVars := func(opt, optarg string, hasOptarg bool) int {
+		status := 0
+		for _, err := range []error{
+			fm.SetVar("OPTIND", strconv.Itoa(optind)), fm.SetVar(name, opt)} {
+			if err != nil {
+				fmt.Fprintln(fm.files[2], err)
+				status = 2
+			}
+		}
+		if hasOptarg {
+			if err := fm.SetVar("OPTARG", optarg); err != nil {
+				fmt.Fprintln(fm.files[2], err)
+				status = 2
+			}
+		} else if !fm.variables.readonly.has("OPTARG") {
+			delete(fm.variables.values, "OPTARG")
+		}
+		// Must be done after setting $OPTIND, which resets the state.
+		fm.getoptsState.offset = offset
+		return status
+	}
+
+	if offset == 0 {
+		if optind > len(args) || args[optind-1] == "-" || !strings.HasPrefix(args[optind-1], "-") {
+			// End of options.
+			setVars("?", "", false)
+			return 1
+		} else if args[optind-1] == "--" {
+			optind++
+			setVars("?", "", false)
+			return 1
+		}
+		offset = 1
+	}
+
+	arg := args[optind-1]
+	if offset >= len(arg) {
+		// The arguments have changed since the last call.
+		offset = 0
+		optind++
+		setVars("?", "", false)
+		return 1
+	}
+	opt := arg[offset]
+	offset++
+	// Advance to the next argument if the current one has been used up.
+	next := func() {
+		if offset == len(arg) {
+			optind++
+			offset = 0
+		}
+	}
+
+	i := strings.IndexByte(optstring, opt)
+	if i == -1 || opt == ':' {
+		next()
+		if silent {
+			return setVars("?", string(opt), true)
+		}
+		// POSIX leaves the format of the message unspecified. We follow
+		// bash and ksh.
+		fmt.Fprintf(fm.files[2], "%v: illegal option -- %c\n", fm.arguments[0], opt)
+		return setVars("?", "", false)
+	}
+	if i+1 == len(optstring) || optstring[i+1] != ':' {
+		next()
+		return setVars(string(opt), "", false)
+	}
+	// The option requires an argument, which is either the rest of the
+	// current argument or the next argument.
+	var optarg string
+	if offset < len(arg) {
+		optarg = arg[offset:]
+		optind++
+	} else if optind < len(args) {
+		optarg = args[optind]
+		optind += 2
+	} else {
+		optind++
+		offset = 0
+		if silent {
+			return setVars(":", string(opt), true)
+		}
+		fmt.Fprintf(fm.files[2], "%v: option requires an argument -- %c\n", fm.arguments[0], opt)
+		return setVars("?", "", false)
+	}
+	offset = 0
+	return setVars(string(opt), optarg, true)
 }
 
 func hashCmd(fm *frame, args []string) int {
-	// TODO
-	return 0
+	opts, args, err := getopts(args, "r")
+	if err != nil {
+		fm.badCommandLine("%v", err)
+		return StatusBadCommandLine
+	}
+	if opts.has('r') {
+		for name := range fm.hashed {
+			delete(fm.hashed, name)
+		}
+		return 0
+	}
+	if len(args) == 0 {
+		// POSIX leaves the format unspecified; we use the same format as
+		// alias, which is also what ksh uses.
+		for _, name := range sortedNames(fm.hashed) {
+			fmt.Fprintf(fm.files[1], "%v=%v\n", quote(name), quote(fm.hashed[name]))
+		}
+		return 0
+	}
+	status := 0
+	for _, name := range args {
+		// POSIX specifies that builtins and functions are not searched for,
+		// and names containing slashes are never remembered.
+		if strings.Contains(name, "/") || isBuiltinOrFunction(fm, name) {
+			continue
+		}
+		// Always search again, so that "hash name" can be used to update a
+		// location that is no longer valid.
+		path, st := fm.lookExecutable(name, fm.getVar("PATH"))
+		if st != 0 {
+			status = 1
+			continue
+		}
+		fm.hashed[name] = path
+	}
+	return status
+}
+
+func isBuiltinOrFunction(fm *frame, name string) bool {
+	_, special := specialBuiltins[name]
+	_, function := fm.functions[name]
+	return special || function || isRegularBuiltin(name)
+}
+
+func isRegularBuiltin(name string) bool {
+	_, builtin := builtins[name]
+	_, aborting := abortingBuiltins[name]
+	return builtin || aborting
 }
 
 func jobsCmd(fm *frame, args []string) int {
-	// TODO
+	opts, args, err := getopts(args, "lp")
+	if err != nil {
+		fm.badCommandLine("%v", err)
+		return StatusBadCommandLine
+	}
+	jt := fm.jobs.forJobsCmd()
+	jobs := jt.all()
+	if len(args) > 0 {
+		jobs = jobs[:0]
+		for _, arg := range args {
+			j, err := jt.find(arg)
+			if err != nil {
+				fm.badCommandLine("%v", err)
+				return StatusBadCommandLine
+			} else if j == nil {
+				fmt.Fprintf(fm.files[2], "no such job: %v\n", arg)
+				return 1
+			}
+			jobs = append(jobs, j)
+		}
+	}
+	// POSIX specifies that -l and -p are mutually exclusive but doesn't specify
+	// what to do when both are given. We let the latter take precedence, like
+	// bash and ksh.
+	long, pidOnly := false, false
+	for _, opt := range opts {
+		long, pidOnly = opt.name == 'l', opt.name == 'p'
+	}
+	cur, prev := jt.currentAndPrevious()
+	for _, j := range jobs {
+		if pidOnly {
+			fmt.Fprintln(fm.files[1], j.leader())
+			continue
+		}
+		fmt.Fprint(fm.files[1], formatJob(j, cur, prev, long))
+		// Like other shells, forget about finished jobs once their status
+		// has been reported.
+		if j.finished() {
+			jt.remove(j)
+		}
+	}
 	return 0
 }
 
@@ -361,6 +828,10 @@ func readCmd(fm *frame, args []string) int {
 		return StatusBadCommandLine
 	}
 	raw := opts.has('r')
+	if fm.files[0] == nil {
+		fmt.Fprintln(fm.files[2], "read: stdin is closed")
+		return 1
+	}
 	var sb strings.Builder
 	for {
 		line := getLine(fm.files[0])
@@ -580,6 +1051,34 @@ func unaliasCmd(fm *frame, args []string) int {
 }
 
 func waitCmd(fm *frame, args []string) int {
-	// TODO
-	return 0
+	if len(args) == 0 {
+		// POSIX specifies that wait waits for all known jobs and returns 0
+		// when called with no arguments.
+		for _, j := range fm.jobs.all() {
+			<-j.done
+			fm.jobs.remove(j)
+		}
+		return 0
+	}
+	jobs := make([]*job, len(args))
+	for i, arg := range args {
+		j, err := fm.jobs.find(arg)
+		if err != nil {
+			fm.badCommandLine("%v", err)
+			return StatusBadCommandLine
+		}
+		jobs[i] = j
+	}
+	// The status is that of the job designated by the last argument.
+	status := 0
+	for _, j := range jobs {
+		if j == nil {
+			status = StatusWaitUnknownJob
+			continue
+		}
+		<-j.done
+		fm.jobs.remove(j)
+		status = j.status
+	}
+	return status
 }
@@ -15,6 +15,9 @@ import (
 
 	"github.com/elves/posixsh/pkg/arith"
 	"github.com/elves/posixsh/pkg/parse"
+	"golang.org/x/sys/unix"
+	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/sys"
 )
 
 type Evaler struct {
@@ -23,6 +26,12 @@ type Evaler struct {
 	variables variables
 	functions map[string]*parse.Command
 	aliases   map[string]string
+	hashed    map[string]string
+	jobs      *jobTable
+	traps     *trapTable
+	history   *history
+	// Created by (*Evaler).frame.
+	top *frame
 }
 
 var StdFiles = []*os.File{os.Stdin, os.Stdout, os.Stderr}
@@ -40,34 +49,96 @@ func NewEvaler(args []string, files []*os.File) *Evaler {
 		initVariablesFromEnv(os.Environ()),
 		make(map[string]*parse.Command),
 		make(map[string]string),
+		make(map[string]string),
+		newJobTable(nil),
+		newTrapTable(),
+		newHistory(),
+		nil,
 	}
 }
 
+// Eval parses and evaluates code. Diagnostic messages use $0 as the name of
+// the code.
+//
+// Like a script, the code is parsed and evaluated one complete command at a
+// time, so aliases defined in the code take effect on later lines.
 func (ev *Evaler) Eval(code string) int {
-	n, err := parse.Parse(code)
-	if err != nil {
-		// TODO: Add range information.
-		fmt.Fprintln(ev.files[2], "syntax error:", err)
-		return StatusSyntaxError
-	}
-	return ev.EvalChunk(n)
+	fm := ev.frame()
+	status, _ := fm.evalCode(ev.arguments[0], code, fm.topChunk)
+	return status
 }
 
-func (ev *Evaler) EvalChunk(n *parse.Chunk) int {
-	status, _ := ev.frame().topChunk(n)
-	return status
+// Alias returns the definition of an alias. It can be passed to
+// parse.NewReader for alias substitution.
+func (ev *Evaler) Alias(name string) (string, bool) {
+	return ev.frame().alias(name)
+}
+
+// EvalChunk evaluates a parsed chunk. It returns the status, and whether the
+// evaluation completed without being aborted by a fatal error or the exit
+// command. A non-interactive shell should exit in the latter case.
+func (ev *Evaler) EvalChunk(n *parse.Chunk) (int, bool) {
+	return ev.frame().topChunk(n)
 }
 
+// Returns the frame for evaluating top-level code. The frame is created upon
+// the first call and reused afterwards, so that state like the shell options,
+// the working directory and $? persist across multiple calls to EvalChunk.
 func (ev *Evaler) frame() *frame {
+	if fm := ev.top; fm != nil {
+		// Reset state that only makes sense within one evaluation, in case the
+		// last evaluation was aborted by a fatal error.
+		fm.currentCommand = nil
+		fm.loopDepth, fm.loopAbort = 0, nil
+		fm.fnLevel, fm.fnAbort = 0, false
+		fm.errexitIgnored = false
+		if fm.traps.interrupted != nil {
+			fm.traps.interrupted.Store(false)
+		}
+		return fm
+	}
 	wd, err := os.Getwd()
 	if err != nil {
 		wd = "/"
 	}
 	ev.variables.values["PWD"] = wd
-	return &frame{
+	ev.top = &frame{
 		ev.files, ev.arguments, ev.variables, ev.functions, ev.aliases,
-		ev.files[2], wd,
-		0, 0, 0, nil, 0, nil, 0, false}
+		ev.hashed, ev.jobs, ev.traps, ev.history, ev.files[2], nil, wd,
+		0, 0, 0, 0, nil, nil, nil, 0, nil, 0, false, false, false, false,
+		getoptsState{}, false}
+	return ev.top
+}
+
+// Exited returns whether the exit command has been called to exit the shell.
+// It can be used by interactive shells, which don't exit on other fatal errors.
+func (ev *Evaler) Exited() bool {
+	return ev.top != nil && ev.top.exited
+}
+
+// SetOption turns a shell option on or off. The name is the long name used in
+// "set -o", like "errexit".
+func (ev *Evaler) SetOption(name string, on bool) error {
+	bit, ok := optionByName[name]
+	if !ok {
+		return fmt.Errorf("unknown option %s", name)
+	}
+	fm := ev.frame()
+	fm.options = fm.options.with(bit, on)
+	return nil
+}
+
+// SetInteractive marks the shell as interactive.
+func (ev *Evaler) SetInteractive() {
+	fm := ev.frame()
+	fm.options = fm.options.with(interactive, true)
+}
+
+// Option returns whether a shell option is on. The name is the same as in
+// SetOption; it returns false for unknown names.
+func (ev *Evaler) Option(name string) bool {
+	bit, ok := optionByName[name]
+	return ok && ev.frame().options.has(bit)
 }
 
 type frame struct {
@@ -76,11 +147,21 @@ type frame struct {
 	variables variables
 	functions map[string]*parse.Command
 	aliases   map[string]string
+	// Locations of external commands remembered by the shell, maintained by
+	// (*frame).lookCommand and the hash command. Cleared when $PATH changes.
+	hashed  map[string]string
+	jobs    *jobTable
+	traps   *trapTable
+	history *history
 	// POSIX requires all cases except "special built-in utility error" and
 	// "other utility (not a special builtin-in error)" to print a shell
 	// diagnostic message to the stderr, ignoring all active redirections. We
 	// save the initial stderr (files[2]) in this field for that purpose.
 	diagFile *os.File
+	// Files opened by permanent redirections in this frame. They are closed
+	// once permanent redirections leave no FD referring to them. See
+	// (*frame).closeReplaced.
+	permFiles set[*os.File]
 	// Virtualized working directory. Necessary to emulate subshells.
 	wd string
 	// Shell options.
@@ -89,6 +170,15 @@ type frame struct {
 	lastPipelineStatus int
 	// Used as the status of simple commands with only assignments.
 	lastCmdSubstStatus int
+	// Used for $!; 0 when no asynchronous list has been started.
+	lastAsyncPid int
+	// Set when running an asynchronous list that consists of a single simple
+	// command, and reset by (*frame).callCommand. See (*frame).async for
+	// details.
+	reportPid func(pid int)
+	// The job whose process group external commands should join. Only set when
+	// job control is active; see jobcontrol.go for details.
+	job *job
 	// Set during a command call. Useful for diagnostic messages written from
 	// (special) builtins.
 	currentCommand *parse.Command
@@ -116,6 +206,22 @@ type frame struct {
 	// - fnAbort is set to true by the return command.
 	fnLevel int
 	fnAbort bool
+	// Set when the errexit option should be ignored, like in the condition of
+	// an if command. See (*frame).ignoringErrexit.
+	errexitIgnored bool
+	// Whether the frame runs a subshell or a command in a multi-command
+	// pipeline. Both are run in the same process as the shell, so the exec
+	// command can't replace the process.
+	subshell bool
+	// Set by the exec command when it has run a command in place of a
+	// subshell. Used to stop the abort at the last command of a pipeline when
+	// that command is run in the current shell.
+	execAbort bool
+	// Used by the getopts command.
+	getoptsState getoptsState
+	// Set by the exit command when it is called outside subshells. Never
+	// reset.
+	exited bool
 }
 
 type loopAbort struct {
@@ -131,21 +237,75 @@ func (fm *frame) cloneForSubshell() *frame {
 		fm.variables.clone(),
 		cloneMap(fm.functions),
 		cloneMap(fm.aliases),
+		cloneMap(fm.hashed),
+		newJobTable(fm.jobs),
+		fm.traps.cloneForSubshell(),
+		fm.history,
 		fm.diagFile,
+		// Files opened by the parent are not owned by the subshell.
+		nil,
 		fm.wd,
-		fm.options,
+		// Job control is only performed by the shell itself; processes started
+		// by subshells join the process group of the job the subshell belongs
+		// to, if any.
+		fm.options.with(monitor, false),
 		// POSIX doesn't explicitly specify whether subshells inherit $?, but
 		// all of dash, bash, ksh and zsh let subshells inherit $?, so we follow
 		// their behavior.
 		fm.lastPipelineStatus,
-		0, nil, 0, nil, 0, false,
+		0,
+		fm.lastAsyncPid,
+		nil, fm.job, nil, 0, nil, 0, false,
+		// Subshells started when errexit is ignored also ignore errexit. This
+		// is the behavior of dash, bash and ksh. Tested with:
+		//
+		//     $sh -c 'set -e; if (false; echo foo); then :; fi'
+		fm.errexitIgnored,
+		true, false, fm.getoptsState, false,
 	}
 }
 
-// Prints a diagnostic message.
+// Prints a diagnostic message, prefixed with the location of n like
+// "script.sh:3:1: ". If the diagnostic file is a terminal, the location is
+// instead shown after the message, together with an excerpt of the source code.
+//
+// The node may be nil, in which case there is no location information.
 func (fm *frame) diag(n parse.Node, format string, args ...any) {
-	// TODO: Incorporate range information in the error message.
-	fmt.Fprintf(fm.diagFile, format+"\n", args...)
+	msg := fmt.Sprintf(format, args...)
+	if n == nil {
+		fmt.Fprintln(fm.diagFile, msg)
+		return
+	}
+	name, text, line := parse.SourceOf(n)
+	if sys.IsATTY(fm.diagFile.Fd()) {
+		// Pad the text with empty lines so that the context shows the correct
+		// line number.
+		pad := strings.Repeat("\n", line-1)
+		ctx := diag.NewContext(name, pad+text,
+			diag.Ranging{From: len(pad) + n.Begin(), To: len(pad) + n.End()})
+		fmt.Fprintf(fm.diagFile, "%s\n  %s\n", msg, ctx.ShowCompact("  "))
+		return
+	}
+	fmt.Fprintf(fm.diagFile, "%s:%d:%d: %s\n", name, n.Line(), n.Col(), msg)
+}
+
+// Like diag, but uses the location of the current command, if any.
+func (fm *frame) diagCommand(format string, args ...any) {
+	var n parse.Node
+	if fm.currentCommand != nil {
+		n = fm.currentCommand
+	}
+	fm.diag(n, format, args...)
+}
+
+// PrintSyntaxErrors prints errors from parsing code with the given name, in the
+// same format used for syntax errors found by the shell itself. The error must
+// be a parse.Error.
+func PrintSyntaxErrors(w io.Writer, name string, err error) {
+	for _, entry := range err.(parse.Error).Errors {
+		fmt.Fprintf(w, "%s:%d:%d: syntax error: %s\n",
+			name, entry.Line, entry.Col, entry.Message)
+	}
 }
 
 // The rest of this file contains methods on (*frame) that implement the
@@ -200,10 +360,58 @@ func (fm *frame) topChunk(ch *parse.Chunk) (int, bool) {
 			return status, false
 		}
 		lastStatus = status
+		if status, ok := fm.runPendingTraps(); !ok {
+			return status, false
+		}
 	}
 	return lastStatus, true
 }
 
+// Parses and evaluates code one complete command at a time, evaluating each
+// Chunk with evalChunk. Syntax errors are printed, and stop the evaluation with
+// StatusSyntaxError.
+func (fm *frame) evalCode(name, code string, evalChunk func(*parse.Chunk) (int, bool)) (int, bool) {
+	r := parse.NewReader(name, strings.NewReader(code), fm.alias)
+	status := 0
+	syntaxError := false
+	for {
+		n, err := r.Next()
+		if err == io.EOF {
+			if syntaxError {
+				return StatusSyntaxError, false
+			}
+			return status, true
+		} else if err != nil {
+			PrintSyntaxErrors(fm.diagFile, name, err)
+			if _, ok := err.(parse.Error); ok && fm.checking() {
+				// Keep checking the rest of the code; see noexec.go.
+				syntaxError = true
+				continue
+			}
+			return StatusSyntaxError, false
+		}
+		var ok bool
+		status, ok = evalChunk(n)
+		if !ok {
+			return status, false
+		}
+	}
+}
+
+func (fm *frame) alias(name string) (string, bool) {
+	def, ok := fm.aliases[name]
+	return def, ok
+}
+
+// Returns the path resolved against the virtual working directory, which is
+// used as the base for relative paths instead of the process's.
+func (fm *frame) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(fm.wd, path)
+}
+
 func (fm *frame) chunk(ch *parse.Chunk) (int, bool) {
 	return fm.andOrs(ch.AndOrs)
 }
@@ -216,40 +424,220 @@ func (fm *frame) andOrs(aos []*parse.AndOr) (int, bool) {
 			return status, false
 		}
 		lastStatus = status
+		if status, ok := fm.runPendingTraps(); !ok {
+			return status, false
+		}
 	}
 	return lastStatus, true
 }
 
 func (fm *frame) andOr(ao *parse.AndOr) (int, bool) {
+	if fm.checking() {
+		fm.check(ao)
+		return 0, true
+	}
+	if ao.Async {
+		// Starting an asynchronous list always succeeds as far as POSIX is
+		// concerned.
+		fm.async(ao)
+		return 0, true
+	}
+	return fm.andOrSync(ao)
+}
+
+func (fm *frame) andOrSync(ao *parse.AndOr) (int, bool) {
 	var lastStatus int
 	for i, pp := range ao.Pipelines {
 		if i > 0 && shouldSkipAndOr(ao.AndOp[i-1], lastStatus) {
 			continue
 		}
-		status, ok := fm.pipeline(pp)
+		last := i == len(ao.Pipelines)-1
+		var status int
+		var ok bool
+		if last {
+			status, ok = fm.pipeline(pp)
+		} else {
+			// POSIX specifies that errexit is ignored for all but the last
+			// pipeline in an AND-OR list.
+			status, ok = fm.ignoringErrexit(func() (int, bool) {
+				return fm.pipeline(pp)
+			})
+		}
 		fm.lastPipelineStatus = status
 		if !ok {
 			return status, false
 		}
 		lastStatus = status
+		if last && status != 0 && fm.shouldErrexit(pp) {
+			// Exit as if by "exit" with no arguments.
+			return status, false
+		}
 	}
 	return lastStatus, true
 }
 
+// Runs f with the errexit option ignored. POSIX specifies that errexit is
+// ignored in the conditions of if, while and until, pipelines beginning with
+// "!", and all but the last pipeline in an AND-OR list. The effect extends to
+// everything run within these contexts, including function calls.
+func (fm *frame) ignoringErrexit(f func() (int, bool)) (int, bool) {
+	if fm.errexitIgnored {
+		return f()
+	}
+	fm.errexitIgnored = true
+	defer func() { fm.errexitIgnored = false }()
+	return f()
+}
+
+// Returns whether a pipeline that has failed should cause the shell to exit
+// because of the errexit option.
+func (fm *frame) shouldErrexit(pp *parse.Pipeline) bool {
+	if !fm.options.has(errexit) || fm.errexitIgnored || pp.Not {
+		return false
+	}
+	if len(pp.Commands) == 1 {
+		switch pp.Commands[0].Data.(type) {
+		case parse.Simple, parse.SubshellGroup:
+		default:
+			// A compound command other than a subshell can only fail without
+			// causing an exit if the failure happened while errexit was
+			// ignored; any other failure would have caused the shell to exit
+			// already. POSIX specifies that errexit doesn't apply in that case.
+			// Tested with:
+			//
+			//     $sh -c 'set -e; { false && true; }; echo foo'
+			//
+			// Failures of the redirections of the compound command itself are
+			// handled in (*frame).command instead.
+			return false
+		}
+	}
+	return true
+}
+
+// Runs an asynchronous list in a subshell without waiting for it, adds it to
+// the job table, and sets $!.
+//
+// Since there is no fork, the subshell is run in a goroutine of the same
+// process, and the PID we use for $! is only a pseudo PID in general. However,
+// the most common use of asynchronous lists is to start one external command
+// (like "daemon &") and later refer to it with $!, so when the asynchronous
+// list consists of a single simple command, we let (*frame).callCommand report
+// the PID of the external command back via fm.reportPid, and use it as $!.
+func (fm *frame) async(ao *parse.AndOr) {
+	// Finished jobs are reaped before writing the prompt when job control is
+	// active in an interactive shell, so that they can be reported; see
+	// (*Evaler).ReportJobs. Otherwise reap them here.
+	if !fm.options.has(monitor) || !fm.options.has(interactive) {
+		fm.jobs.reap()
+	}
+	newFm := fm.cloneForSubshell()
+	// Asynchronous lists are not interrupted by SIGINT.
+	newFm.traps.interrupted = nil
+	// The subshell may outlive the redirections currently in effect, so give it
+	// its own copies of the files.
+	for i, f := range newFm.files {
+		if f == nil {
+			continue
+		}
+		dup, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			fm.diag(ao, "unable to duplicate FD %v for asynchronous list: %v", i, err)
+			newFm.files[i] = nil
+			continue
+		}
+		newFm.files[i] = os.NewFile(uintptr(dup), f.Name())
+	}
+	if !fm.options.has(monitor) {
+		// POSIX specifies that when job control is disabled, the stdin of an
+		// asynchronous list is equivalent to /dev/null before any explicit
+		// redirections.
+		if newFm.files[0] != nil {
+			newFm.files[0].Close()
+		}
+		devNull, err := os.Open(os.DevNull)
+		if err != nil {
+			fm.diag(ao, "unable to open %v for asynchronous list: %v", os.DevNull, err)
+		}
+		newFm.files[0] = devNull
+	}
+
+	pidCh := make(chan int, 1)
+	var reportOnce sync.Once
+	reportPid := func(pid int) {
+		reportOnce.Do(func() {
+			if pid == 0 {
+				pid = newPseudoPid()
+			}
+			pidCh <- pid
+		})
+	}
+	if len(ao.Pipelines) == 1 && len(ao.Pipelines[0].Commands) == 1 {
+		if _, ok := ao.Pipelines[0].Commands[0].Data.(parse.Simple); ok {
+			newFm.reportPid = reportPid
+		}
+	}
+	if newFm.reportPid == nil {
+		reportPid(0)
+	}
+
+	text := strings.TrimSpace(ao.Source())
+	j := newJob(strings.TrimSpace(strings.TrimSuffix(text, "&")))
+	if fm.options.has(monitor) {
+		newFm.job = j
+	}
+	// Redirections in the subshell may modify newFm.files in place, so save a
+	// copy for closing the files later.
+	files := cloneSlice(newFm.files)
+	go func() {
+		status, _ := newFm.andOrSync(ao)
+		j.status = newFm.runExitTrap(status)
+		// In case the simple command didn't reach (*frame).callCommand, for
+		// example because of an expansion error.
+		reportPid(0)
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+		close(j.done)
+	}()
+	j.pid = <-pidCh
+	fm.jobs.add(j)
+	fm.lastAsyncPid = j.pid
+}
+
 func shouldSkipAndOr(and bool, lastStatus int) bool {
 	return (and && lastStatus != 0) || (!and && lastStatus == 0)
 }
 
 func (fm *frame) pipeline(pl *parse.Pipeline) (int, bool) {
+	if pl.Not {
+		status, ok := fm.ignoringErrexit(func() (int, bool) {
+			return fm.pipelineWithoutNot(pl)
+		})
+		return not(status), ok
+	}
+	return fm.pipelineWithoutNot(pl)
+}
+
+func (fm *frame) pipelineWithoutNot(pl *parse.Pipeline) (int, bool) {
+	if fm.options.has(monitor) && fm.job == nil {
+		// This pipeline is run as a foreground job. See jobcontrol.go for
+		// details.
+		j := newJob(strings.TrimSpace(pl.Source()))
+		j.foreground, j.owner = true, fm
+		fm.job = j
+		defer func() {
+			fm.job = nil
+			reclaimTerminal()
+		}()
+	}
 	n := len(pl.Commands)
 	if n == 1 {
-		// Short path
-		f := pl.Commands[0]
-		if len(f.Redirs) > 0 {
-			files := cloneSlice(fm.files)
-			defer func() { fm.files = files }()
-		}
-		return fm.command(f)
+		// Short path. Redirections are undone by (*frame).command if
+		// necessary; they are permanent for "exec".
+		return fm.command(pl.Commands[0])
 	}
 
 	pipes := make([][2]*os.File, n-1)
@@ -263,7 +651,7 @@ func (fm *frame) pipeline(pl *parse.Pipeline) (int, bool) {
 				pipes[j][0].Close()
 				pipes[j][1].Close()
 			}
-			fm.diag(pl, "unable to create pipe for pipeline:", err)
+			fm.diag(pl, "unable to create pipe for pipeline: %v", err)
 			return StatusPipeError, true
 		}
 		pipes[i][0], pipes[i][1] = r, w
@@ -272,16 +660,31 @@ func (fm *frame) pipeline(pl *parse.Pipeline) (int, bool) {
 	var wg sync.WaitGroup
 	wg.Add(n)
 
-	var lastStatus int
+	// When fm runs a foreground job, the last command is also run in a
+	// subshell. See jobcontrol.go for details.
+	stoppable := fm.job != nil && fm.job.ownedBy(fm)
+
+	// Statuses of all the commands, used for pipefail. The option is read
+	// here, since the job may outlive this call if it is stopped.
+	statuses := make([]int, n)
+	usePipefail := fm.options.has(pipefail)
 	var lastOK bool
 	for i, f := range pl.Commands {
 		var newFm *frame
-		if i < n-1 {
+		if i < n-1 || stoppable {
 			newFm = fm.cloneForSubshell()
-			newFm.files[1] = pipes[i][1]
+			if i < n-1 {
+				newFm.files[1] = pipes[i][1]
+			}
 		} else {
 			files := cloneSlice(fm.files)
 			defer func() { fm.files = files }()
+			// POSIX allows the last command of a pipeline to be run in the
+			// current shell, but it still shares the process with the other
+			// commands.
+			subshell := fm.subshell
+			fm.subshell = true
+			defer func() { fm.subshell = subshell }()
 			newFm = fm
 		}
 		if i > 0 {
@@ -289,10 +692,17 @@ func (fm *frame) pipeline(pl *parse.Pipeline) (int, bool) {
 		}
 		go func(i int, f *parse.Command) {
 			status, ok := newFm.command(f)
+			if newFm != fm {
+				status = newFm.runExitTrap(status)
+			} else if !ok && fm.execAbort {
+				fm.execAbort = false
+				ok = true
+			}
 			// All but the last form is run in a subshell, so even fatal errors
 			// in them don't terminate evaluation.
+			statuses[i] = status
 			if i == n-1 {
-				lastStatus, lastOK = status, ok
+				lastOK = ok
 			}
 			// Close the pipes associated with this command. Use the files
 			// stored in pipes rather than newFm.files because the latter may
@@ -309,11 +719,34 @@ func (fm *frame) pipeline(pl *parse.Pipeline) (int, bool) {
 			wg.Done()
 		}(i, f)
 	}
-	wg.Wait()
-	if pl.Not {
-		return not(lastStatus), lastOK
+	if stoppable {
+		status, stopped := fm.runStoppable(func() int {
+			wg.Wait()
+			return pipelineStatus(statuses, usePipefail)
+		})
+		if stopped {
+			return status, true
+		}
+	} else {
+		wg.Wait()
+	}
+	return pipelineStatus(statuses, usePipefail), lastOK
+}
+
+// Returns the status of a pipeline from the statuses of its commands. POSIX
+// specifies that this is the status of the last command. With the pipefail
+// option, which is not in POSIX but supported by bash, ksh and zsh, it is the
+// status of the last command that failed, or 0 if all commands succeeded.
+func pipelineStatus(statuses []int, pipefail bool) int {
+	if pipefail {
+		for i := len(statuses) - 1; i >= 0; i-- {
+			if statuses[i] != 0 {
+				return statuses[i]
+			}
+		}
+		return 0
 	}
-	return lastStatus, lastOK
+	return statuses[len(statuses)-1]
 }
 
 func not(status int) int {
@@ -324,6 +757,14 @@ func not(status int) int {
 }
 
 func (fm *frame) command(c *parse.Command) (int, bool) {
+	// Used by $LINENO; see (*frame).lookupVar. Doing this for compound
+	// commands too gives expansions in their redirections and words (like
+	// those of for) the line number of the compound command.
+	prevCommand := fm.currentCommand
+	fm.currentCommand = c
+	defer func() {
+		fm.currentCommand = prevCommand
+	}()
 	switch data := c.Data.(type) {
 	case parse.Simple:
 		return fm.runSimple(c, data)
@@ -346,6 +787,12 @@ func (fm *frame) command(c *parse.Command) (int, bool) {
 				defer cleanup()
 			}
 			if status != 0 {
+				// Unlike a failure in the body, a failure of the redirections
+				// of a compound command itself hasn't been subject to errexit
+				// yet. See (*frame).shouldErrexit.
+				if ok && fm.options.has(errexit) && !fm.errexitIgnored {
+					return status, false
+				}
 				return status, ok
 			}
 		}
@@ -354,8 +801,16 @@ func (fm *frame) command(c *parse.Command) (int, bool) {
 			return fm.chunk(data.Body)
 		case parse.SubshellGroup:
 			// Fatal errors from subshells are turned into non-fatal errors.
-			status, _ := fm.cloneForSubshell().chunk(data.Body)
-			return status, true
+			newFm := fm.cloneForSubshell()
+			if fm.job != nil && fm.job.ownedBy(fm) {
+				status, _ := fm.runStoppable(func() int {
+					status, _ := newFm.chunk(data.Body)
+					return newFm.runExitTrap(status)
+				})
+				return status, true
+			}
+			status, _ := newFm.chunk(data.Body)
+			return newFm.runExitTrap(status), true
 		case parse.For:
 			return fm.runFor(c, data)
 		case parse.Case:
@@ -381,22 +836,10 @@ func (fm *frame) runSimple(c *parse.Command, data parse.Simple) (int, bool) {
 	// 2.9.1 Simple Commands. POSIX allows for redirections and assignments to
 	// swap position if the command is a special builtin, but we don't do that.
 
-	// POSIX requires alias substitution to happen after tokenizing but before
-	// further parsing; this behavior is followed by all of dash, bash, ksh and
-	// zsh.
-	//
-	// However, we parse most things statically and don't feed the expanded
-	// alias back to the parser, and the alias command explicitly only supports
-	// aliases that consist of barewords. For this subset of aliases we do
-	// support, we can match the POSIX behavior by expanding aliases as early as
-	// possible, so that they can - for example - shadow special builtins.
-	head, tail := expandAlias(data.Words, fm.aliases)
-
-	tailWords, ok := fm.expandCompounds(tail)
+	words, ok := fm.expandCompounds(data.Words, true)
 	if !ok {
 		return StatusExpansionError, false
 	}
-	words := append(head, tailWords...)
 
 	isSpecial := len(words) > 0 && specialBuiltins[words[0]] != nil
 
@@ -410,10 +853,17 @@ func (fm *frame) runSimple(c *parse.Command, data parse.Simple) (int, bool) {
 	}
 
 	for _, rd := range c.Redirs {
+		var oldFiles []*os.File
+		if permRedir && len(words) == 1 {
+			oldFiles = cloneSlice(fm.files)
+		}
 		status, ok, cleanup := fm.redir(rd)
-		if cleanup != nil {
+		if cleanup != nil && !permRedir {
 			defer cleanup()
 		}
+		if oldFiles != nil {
+			fm.closeReplaced(oldFiles, cleanup != nil)
+		}
 		if status != 0 {
 			if isSpecial {
 				// POSIX specifies that redirection errors are fatal when
@@ -436,7 +886,7 @@ func (fm *frame) runSimple(c *parse.Command, data parse.Simple) (int, bool) {
 		}
 	}
 	for _, assign := range c.Assigns {
-		exp, ok := fm.compound(assign.RHS)
+		exp, ok := fm.assignValue(assign.RHS, -1)
 		if !ok {
 			return StatusExpansionError, false
 		}
@@ -451,6 +901,7 @@ func (fm *frame) runSimple(c *parse.Command, data parse.Simple) (int, bool) {
 					fm.variables.values[name] = value
 				}()
 			}
+			defer fm.varChanged(name)
 			// When the allexport option is active, setting a variable will also
 			// export it, so undo it.
 			//
@@ -473,17 +924,16 @@ func (fm *frame) runSimple(c *parse.Command, data parse.Simple) (int, bool) {
 	// also don't agree on how temporary assignments and redirections should be
 	// printed.
 	//
-	// We mostly follow dash's behavior: one +, print assignments but not
-	// redirections.
+	// We mostly follow dash's behavior: print assignments but not
+	// redirections. The trace is prefixed with the expanded value of $PS4,
+	// which is required by POSIX.
 	if fm.options.has(xtrace) {
-		fm.files[2].WriteString("+")
+		var fields []string
 		for _, assign := range c.Assigns {
-			fmt.Fprintf(fm.files[2], " %v=%v", assign.LHS, quote(fm.getVar(assign.LHS)))
-		}
-		for _, word := range words {
-			fmt.Fprintf(fm.files[2], " %v", word)
+			fields = append(fields, assign.LHS+"="+quote(fm.getVar(assign.LHS)))
 		}
-		fm.files[2].WriteString("\n")
+		fields = append(fields, words...)
+		fmt.Fprintf(fm.files[2], "%s%s\n", fm.ps4(), strings.Join(fields, " "))
 	}
 
 	if len(words) == 0 {
@@ -500,6 +950,15 @@ func (fm *frame) runSimple(c *parse.Command, data parse.Simple) (int, bool) {
 }
 
 func (fm *frame) callCommand(words []string, c *parse.Command, callFn bool) (int, bool) {
+	// Only an external command started directly by an asynchronous list can
+	// supply the PID for $!; in all other cases, a pseudo PID is used. See
+	// (*frame).async for details.
+	reportPid := fm.reportPid
+	fm.reportPid = nil
+	if reportPid == nil {
+		reportPid = func(int) {}
+	}
+
 	prevCommand := fm.currentCommand
 	fm.currentCommand = c
 	defer func() {
@@ -511,12 +970,16 @@ func (fm *frame) callCommand(words []string, c *parse.Command, callFn bool) (int
 	// for the "command" builtin.
 
 	if builtin, ok := specialBuiltins[words[0]]; ok {
-		return builtin(fm, words[1:])
+		reportPid(0)
+		return fm.runBuiltin(words[0], func() (int, bool) {
+			return builtin(fm, words[1:])
+		})
 	}
 
 	// Functions?
 	if callFn {
 		if fn, ok := fm.functions[words[0]]; ok {
+			reportPid(0)
 			return fm.callFuncLike(words[1:], func() (int, bool) {
 				return fm.command(fn)
 			})
@@ -524,13 +987,29 @@ func (fm *frame) callCommand(words []string, c *parse.Command, callFn bool) (int
 	}
 
 	// Builtins?
+	if builtin, ok := abortingBuiltins[words[0]]; ok {
+		reportPid(0)
+		return fm.runBuiltin(words[0], func() (int, bool) {
+			return builtin(fm, words[1:])
+		})
+	}
 	if builtin, ok := builtins[words[0]]; ok {
-		return builtin(fm, words[1:]), true
+		reportPid(0)
+		return fm.runBuiltin(words[0], func() (int, bool) {
+			return builtin(fm, words[1:]), true
+		})
 	}
 
 	// External commands?
-	path, status := fm.lookExecutable(words[0], fm.getVar("PATH"))
+	return fm.runExternal(words, c, reportPid)
+}
+
+// Runs an external command and waits for it to finish. The reportPid function
+// is called with the PID of the process, or 0 if no process was started.
+func (fm *frame) runExternal(words []string, c *parse.Command, reportPid func(int)) (int, bool) {
+	path, status := fm.lookCommand(words[0])
 	if status != 0 {
+		reportPid(0)
 		return status, true
 	}
 	words[0] = path
@@ -542,24 +1021,87 @@ func (fm *frame) callCommand(words []string, c *parse.Command, callFn bool) (int
 		proc, err = fm.startProcess(append([]string{"/bin/sh"}, words...))
 	}
 	if err != nil {
+		reportPid(0)
 		fm.diag(c, "command not executable: %v", err)
 		return StatusCommandNotExecutable, true
 	}
+	reportPid(proc.Pid)
 
-	state, err := proc.Wait()
-	if err != nil {
-		fm.diag(c, "error waiting for process to finish: %v", err)
-		return StatusWaitError, true
-	}
-	if state.Exited() {
-		return state.ExitCode(), true
+	if fm.job != nil {
+		status = fm.waitJobProcess(proc)
 	} else {
-		waitStatus := state.Sys().(syscall.WaitStatus)
-		if waitStatus.Signaled() {
-			return StatusSignalBase + int(waitStatus.Signal()), true
+		state, err := proc.Wait()
+		if err != nil {
+			fm.diag(c, "error waiting for process to finish: %v", err)
+			return StatusWaitError, true
+		}
+		status = statusFromWaitStatus(state.Sys().(syscall.WaitStatus))
+	}
+	if status == StatusSignalBase+int(unix.SIGINT) {
+		// With job control, SIGINT from the terminal is only sent to the
+		// foreground process group, which the shell is not in. Like bash,
+		// treat the command being killed by SIGINT as the shell receiving it.
+		fm.traps.interrupt()
+	}
+	return status, true
+}
+
+// Builtins that run other commands with the FD table of the frame.
+var builtinsRunningCommands = map[string]bool{
+	".": true, "command": true, "eval": true, "exec": true, "exit": true,
+	"fc": true,
+}
+
+// Runs a builtin, turning writes to a closed stdout or stderr into an error.
+//
+// Builtins write to fm.files directly, and writing to a nil *os.File fails
+// silently, since the error is not checked. All of dash, bash, ksh and zsh
+// report an error and fail in this case, for example with "pwd >&-". To
+// emulate this behavior without checking errors in every builtin, a closed
+// stdout or stderr is replaced with a pipe during the call, and anything
+// written to the pipe is treated as an error.
+//
+// This is not done for builtins that run other commands, since the latter
+// should see the FD as closed.
+func (fm *frame) runBuiltin(name string, f func() (int, bool)) (int, bool) {
+	if builtinsRunningCommands[name] {
+		return f()
+	}
+	type detector struct {
+		fd    int
+		w     *os.File
+		wrote chan bool
+	}
+	var detectors []detector
+	for fd := 1; fd <= 2 && fd < len(fm.files); fd++ {
+		if fm.files[fd] != nil {
+			continue
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			continue
 		}
-		return StatusWaitOther, true
+		wrote := make(chan bool, 1)
+		go func() {
+			n, _ := io.Copy(io.Discard, r)
+			r.Close()
+			wrote <- n > 0
+		}()
+		fm.files[fd] = w
+		detectors = append(detectors, detector{fd, w, wrote})
 	}
+	status, ok := f()
+	for _, d := range detectors {
+		if fm.files[d.fd] == d.w {
+			fm.files[d.fd] = nil
+		}
+		d.w.Close()
+		if <-d.wrote && status == 0 {
+			fm.diagCommand("%v: write error: bad file descriptor", name)
+			status = 1
+		}
+	}
+	return status, ok
 }
 
 func (fm *frame) callFuncLike(args []string, f func() (int, bool)) (int, bool) {
@@ -578,6 +1120,23 @@ func (fm *frame) callFuncLike(args []string, f func() (int, bool)) (int, bool) {
 	return status, ok
 }
 
+// Like lookExecutable with $PATH, but also consults and updates the remembered
+// locations of commands. POSIX allows the shell to remember locations without
+// an explicit hash command.
+func (fm *frame) lookCommand(name string) (string, int) {
+	if strings.Contains(name, "/") {
+		return fm.lookExecutable(name, fm.getVar("PATH"))
+	}
+	if path, ok := fm.hashed[name]; ok {
+		return path, 0
+	}
+	path, status := fm.lookExecutable(name, fm.getVar("PATH"))
+	if status == 0 {
+		fm.hashed[name] = path
+	}
+	return path, status
+}
+
 // Looks for executable. Handles error reporting, using fm.currentCommand for
 // range information in diagnostics.
 func (fm *frame) lookExecutable(name, path string) (string, int) {
@@ -586,20 +1145,70 @@ func (fm *frame) lookExecutable(name, path string) (string, int) {
 		return path, 0
 	}
 	if exists {
-		fm.diag(fm.currentCommand, "command not executable: %v", name)
+		fm.diagCommand("command not executable: %v", name)
 		return "", StatusCommandNotExecutable
 	} else {
-		fm.diag(fm.currentCommand, "command not found: %v", name)
+		fm.diagCommand("command not found: %v", name)
 		return "", StatusCommandNotFound
 	}
 }
 
 func (fm *frame) startProcess(words []string) (*os.Process, error) {
-	return os.StartProcess(words[0], words, &os.ProcAttr{
+	// Nil files are FDs closed with redirections like ">&-". They are closed
+	// in the child process too; os.StartProcess handles nil files this way, and
+	// trailing ones can be omitted altogether.
+	files := fm.files
+	for len(files) > 0 && files[len(files)-1] == nil {
+		files = files[:len(files)-1]
+	}
+	attr := &os.ProcAttr{
 		Dir:   fm.wd,
 		Env:   fm.variables.serializeEnvEntries(),
-		Files: fm.files,
-	})
+		Files: files,
+	}
+	if fm.job != nil {
+		return fm.job.startProcess(words, attr)
+	}
+	return os.StartProcess(words[0], words, attr)
+}
+
+// Replaces the process with an external command, applying the virtual working
+// directory, the exported variables and the FD table of fm. It only returns
+// when there is an error, in which case the state of the process may have
+// been partially modified.
+func (fm *frame) execProcess(words []string) error {
+	err := os.Chdir(fm.wd)
+	if err != nil {
+		return err
+	}
+	// Duplicate all the files to FDs beyond the FD table first, so that
+	// installing one FD doesn't clobber the source of another one. The
+	// duplicates are close-on-exec, like all the other files opened by Go.
+	n := len(fm.files)
+	fds := make([]int, n)
+	for i, f := range fm.files {
+		fds[i] = -1
+		if f != nil {
+			fds[i], err = unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i, fd := range fds {
+		if fd == -1 {
+			unix.Close(i)
+		} else if err := unix.Dup2(fd, i); err != nil {
+			return err
+		}
+	}
+	env := fm.variables.serializeEnvEntries()
+	err = syscall.Exec(words[0], words, env)
+	if errors.Is(err, syscall.ENOEXEC) {
+		// See the comment in (*frame).runExternal.
+		err = syscall.Exec("/bin/sh", append([]string{"/bin/sh"}, words...), env)
+	}
+	return err
 }
 
 func (fm *frame) runFnDef(c *parse.Command, data parse.FnDef) (int, bool) {
@@ -627,7 +1236,7 @@ func (fm *frame) runFor(c *parse.Command, data parse.For) (int, bool) {
 		values = fm.arguments[1:]
 	} else {
 		var ok bool
-		values, ok = fm.expandCompounds(data.Values)
+		values, ok = fm.expandCompounds(data.Values, false)
 		if !ok {
 			return StatusExpansionError, false
 		}
@@ -696,7 +1305,9 @@ func (fm *frame) runCase(c *parse.Command, data parse.Case) (int, bool) {
 
 func (fm *frame) runIf(c *parse.Command, data parse.If) (int, bool) {
 	for i, condition := range data.Conditions {
-		status, ok := fm.andOrs(condition)
+		status, ok := fm.ignoringErrexit(func() (int, bool) {
+			return fm.andOrs(condition)
+		})
 		if !ok {
 			return status, false
 		}
@@ -721,7 +1332,9 @@ func (fm *frame) runUntil(c *parse.Command, data parse.Until) (int, bool) {
 func (fm *frame) runWhileUntil(c *parse.Command, condition, body []*parse.AndOr, wantZero bool) (int, bool) {
 	lastStatus := 0
 	for {
-		status, ok := fm.andOrs(condition)
+		status, ok := fm.ignoringErrexit(func() (int, bool) {
+			return fm.andOrs(condition)
+		})
 		if !ok {
 			return status, false
 		}
@@ -820,8 +1433,11 @@ func (fm *frame) redir(rd *parse.Redir) (int, bool, func() error) {
 				src = nil
 			} else if fd64, err := strconv.ParseInt(right, 10, 0); err == nil {
 				fd := int(fd64)
-				if 0 <= fd && fd < len(fm.files) {
+				if 0 <= fd && fd < len(fm.files) && fm.files[fd] != nil {
 					src = fm.files[fd]
+				} else if 0 <= fd && fd < len(fm.files) {
+					fm.diag(rd, "source FD is closed: %v", right)
+					return StatusRedirectionError, true, nil
 				} else {
 					fm.diag(rd, "source FD is out of range: %v", right)
 					return StatusRedirectionError, true, nil
@@ -831,11 +1447,7 @@ func (fm *frame) redir(rd *parse.Redir) (int, bool, func() error) {
 				return StatusRedirectionError, true, nil
 			}
 		} else {
-			// Use virtual working directory as the base for relative paths.
-			if !filepath.IsAbs(right) {
-				right = filepath.Join(fm.wd, right)
-			}
-			f, err := os.OpenFile(right, flag, 0644)
+			f, err := os.OpenFile(fm.absPath(right), flag, 0644)
 			if err != nil {
 				fm.diag(rd, "can't open redirection source: %v", err)
 				return StatusRedirectionError, true, nil
@@ -853,19 +1465,49 @@ func (fm *frame) redir(rd *parse.Redir) (int, bool, func() error) {
 		copy(newFiles, fm.files)
 		fm.files = newFiles
 	}
-	if src == nil {
-		// TODO
-		fm.diag(rd, "closing FD not implemented yet")
-		return StatusRedirectionError, false, nil
-	}
+	// A nil src closes dst.
 	fm.files[dst] = src
 	return 0, true, cleanup
 }
 
-func (fm *frame) expandCompounds(cps []*parse.Compound) ([]string, bool) {
+// Called after a permanent redirection made by "exec" without a command, with
+// the FD table before the redirection. Records the newly opened file if opened
+// is true, and closes the files the redirection replaced if they were opened
+// by earlier permanent redirections and no other FD refers to them.
+//
+// Without this, "exec 3>&-" would only remove the file from the FD table, and
+// for example a process reading from a FIFO would never see EOF.
+func (fm *frame) closeReplaced(oldFiles []*os.File, opened bool) {
+	for fd, f := range fm.files {
+		if opened && f != nil && (fd >= len(oldFiles) || f != oldFiles[fd]) {
+			if fm.permFiles == nil {
+				fm.permFiles = make(set[*os.File])
+			}
+			fm.permFiles.add(f)
+		}
+	}
+	for _, f := range oldFiles {
+		if f == nil || !fm.permFiles.has(f) || contains(fm.files, f) {
+			continue
+		}
+		f.Close()
+		fm.permFiles.del(f)
+	}
+}
+
+// Expands words. If isCommand is true, the words form a simple command, and if
+// the command is export or readonly, arguments in the form of assignments are
+// expanded like values of assignments.
+func (fm *frame) expandCompounds(cps []*parse.Compound, isCommand bool) ([]string, bool) {
 	var result []string
 	for _, cp := range cps {
-		exp, ok := fm.compound(cp)
+		var exp expander
+		var ok bool
+		if isCommand && len(result) > 0 && (result[0] == "export" || result[0] == "readonly") {
+			exp, ok = fm.declarationArg(cp)
+		} else {
+			exp, ok = fm.compound(cp)
+		}
 		if !ok {
 			return nil, false
 		}
@@ -900,6 +1542,73 @@ func (fm *frame) compound(cp *parse.Compound) (expander, bool) {
 	return c, true
 }
 
+var assignPrefix = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*=`)
+
+// Evaluates an argument to export or readonly. Like dash and bash, arguments in
+// the form of assignments undergo tilde expansion like values of assignments,
+// so that "export PATH=~/bin:$PATH" works.
+func (fm *frame) declarationArg(cp *parse.Compound) (expander, bool) {
+	if cp.TildePrefix == "" && len(cp.Parts) > 0 && cp.Parts[0].Type == parse.BarewordPrimary {
+		if prefix := assignPrefix.FindString(cp.Parts[0].Value); prefix != "" {
+			return fm.assignValue(cp, len(prefix))
+		}
+	}
+	return fm.compound(cp)
+}
+
+// Evaluates the value of an assignment. POSIX requires tilde prefixes after
+// each unquoted ":" to be expanded, in addition to the one at the start of the
+// value, so that "PATH=~/bin:~alice/bin:$PATH" works. The latter is parsed as
+// the TildePrefix of the compound; if start is not -1, a tilde prefix at that
+// index of the first bareword is also expanded.
+func (fm *frame) assignValue(cp *parse.Compound, start int) (expander, bool) {
+	exp, ok := fm.compound(cp)
+	if !ok {
+		return nil, false
+	}
+	c := exp.(compound)
+	var elems []expander
+	for i, elem := range c.elems {
+		b, isBareword := elem.(bareword)
+		if !isBareword {
+			elems = append(elems, elem)
+			continue
+		}
+		s := b.s
+		// Start of the text that has not been added to elems.
+		from := 0
+		for j := 0; j < len(s); j++ {
+			if s[j] != '~' || !((j > 0 && s[j-1] == ':') || (i == 0 && j == start)) {
+				continue
+			}
+			n := strings.IndexAny(s[j:], "/:")
+			if n == -1 {
+				if i < len(c.elems)-1 {
+					// The tilde prefix is followed by a non-bareword, which
+					// means that it contains quoted characters.
+					continue
+				}
+				n = len(s) - j
+			}
+			home, ok := fm.home(cp, s[j+1:j+n])
+			if !ok {
+				return nil, false
+			}
+			if from < j {
+				elems = append(elems, bareword{s[from:j]})
+			}
+			// Like in compound, the result is considered "quoted".
+			elems = append(elems, literal{home})
+			from = j + n
+			j = from - 1
+		}
+		if from < len(s) {
+			elems = append(elems, bareword{s[from:]})
+		}
+	}
+	return compound{elems}, true
+}
+
 var (
 	userCurrent = user.Current
 	userLookup  = user.Lookup
@@ -920,9 +1629,9 @@ func (fm *frame) home(n parse.Node, uname string) (string, bool) {
 	}
 	if err != nil {
 		if uname == "" {
-			fm.diag(n, "can't get home of current user: %v\n", err)
+			fm.diag(n, "can't get home of current user: %v", err)
 		} else {
-			fm.diag(n, "can't get home of %v: %v\n", uname, err)
+			fm.diag(n, "can't get home of %v: %v", uname, err)
 		}
 		return "", false
 	}
@@ -971,7 +1680,8 @@ func (fm *frame) primary(pr *parse.Primary) (expander, bool) {
 		// TODO: Save exit status for use in commands that only have command
 		// substitutions
 		go func() {
-			fm.lastCmdSubstStatus, _ = newFm.chunk(pr.Body)
+			status, _ := newFm.chunk(pr.Body)
+			fm.lastCmdSubstStatus = newFm.runExitTrap(status)
 			w.Close()
 		}()
 		output, err := io.ReadAll(r)
@@ -983,7 +1693,7 @@ func (fm *frame) primary(pr *parse.Primary) (expander, bool) {
 		// splitting.
 		return expanded{strings.TrimRight(string(output), "\n")}, true
 	case parse.VariablePrimary:
-		return fm.variable(pr.Variable)
+		return fm.variable(pr)
 	default:
 		fm.diag(pr, "shell bug: unknown primary type %v", pr.Type)
 		return literal{}, false
@@ -1015,7 +1725,10 @@ type varInfo struct {
 	scalarVal string
 }
 
-func (fm *frame) variable(v *parse.Variable) (expander, bool) {
+// Expands a variable primary. Diagnostic messages are anchored on the
+// primary, which begins at the "$".
+func (fm *frame) variable(pr *parse.Primary) (expander, bool) {
+	v := pr.Variable
 	name := v.Name
 	// We categorize suffix operators into two classes:
 	//
@@ -1064,12 +1777,12 @@ func (fm *frame) variable(v *parse.Variable) (expander, bool) {
 		}
 	} else {
 		// Normal variable, like $foo.
-		variable, set := fm.variables.values[name]
+		variable, set := fm.lookupVar(name)
 		info = scalarVarInfo(variable, set, true)
 	}
 
 	if !info.set && fm.options.has(nounset) && !hasSubstitutionOp(v) {
-		fm.diag(v, "%v is unset", name)
+		fm.diag(pr, "%v is unset", name)
 		return nil, false
 	}
 
@@ -1162,11 +1875,11 @@ func (fm *frame) variable(v *parse.Variable) (expander, bool) {
 			}
 		default:
 			// The parser doesn't parse other modifiers.
-			fm.diag(v, "bug: unknown operator %v", mod.Operator)
+			fm.diag(pr, "bug: unknown operator %v", mod.Operator)
 			return literal{}, false
 		}
 		if useArg {
-			arg, ok := fm.compound(mod.Argument)
+			arg, ok := fm.modifierArg(mod.Argument)
 			if !ok {
 				return nil, false
 			}
@@ -1174,11 +1887,11 @@ func (fm *frame) variable(v *parse.Variable) (expander, bool) {
 				if info.normal {
 					err := fm.SetVar(v.Name, arg.expandOneString())
 					if err != nil {
-						fm.diag(v, "%v", err)
+						fm.diag(pr, "%v", err)
 						return nil, false
 					}
 				} else {
-					fm.diag(v, "cannot assign to $%v", v.Name)
+					fm.diag(pr, "cannot assign to $%v", v.Name)
 					return nil, false
 				}
 			}
@@ -1192,6 +1905,26 @@ func (fm *frame) variable(v *parse.Variable) (expander, bool) {
 	return array{fm.arguments[1:], fm.ifs, name == "@"}, true
 }
 
+// Evaluates the argument of a substitution modifier like the "foo bar" in
+// "${x:-foo bar}". Unlike in normal words, unquoted text in the argument is
+// subject to field splitting, so barewords are turned into expanded.
+//
+// This is not clearly specified by POSIX, but is consistent with dash, bash and
+// ksh; for example, "IFS=:; echo ${x:-a:b}" writes "a b".
+func (fm *frame) modifierArg(cp *parse.Compound) (expander, bool) {
+	exp, ok := fm.compound(cp)
+	if !ok {
+		return nil, false
+	}
+	c := exp.(compound)
+	for i, elem := range c.elems {
+		if b, ok := elem.(bareword); ok {
+			c.elems[i] = expanded{b.s}
+		}
+	}
+	return c, true
+}
+
 func scalarVarInfo(value string, set, normal bool) varInfo {
 	return varInfo{
 		set:       set,
@@ -1213,8 +1946,10 @@ func (fm *frame) specialScalarVar(name string) (value string, set, ok bool) {
 	case "$":
 		return strconv.Itoa(os.Getpid()), true, true
 	case "!":
-		// TODO
-		return "", false, true
+		if fm.lastAsyncPid == 0 {
+			return "", false, true
+		}
+		return strconv.Itoa(fm.lastAsyncPid), true, true
 	default:
 		return "", false, false
 	}
@@ -1251,9 +1986,19 @@ func (fm *frame) ifs() string {
 	return fm.getVarOr("IFS", " \t\n")
 }
 
-func (fm *frame) ps2() string {
-	// Default value specified in section 2.5.4 "Shell variables".
-	return fm.getVarOr("PS2", "> ")
+// Returns the value of a variable, and whether it is set.
+//
+// POSIX requires $LINENO to be the line number of the command being executed.
+// Instead of storing it as a variable before each command, which would show up
+// in the output of "set" and overwrite assignments, it is computed here unless
+// it has been assigned. Like dash, an assignment to $LINENO is kept; unlike
+// dash, $LINENO is computed again after it is unset.
+func (fm *frame) lookupVar(name string) (string, bool) {
+	value, set := fm.variables.values[name]
+	if !set && name == "LINENO" && fm.currentCommand != nil {
+		return strconv.Itoa(fm.currentCommand.Line()), true
+	}
+	return value, set
 }
 
 func (fm *frame) getVar(name string) string {
@@ -1261,7 +2006,7 @@ func (fm *frame) getVar(name string) string {
 }
 
 func (fm *frame) getVarOr(name, fallback string) string {
-	value, set := fm.variables.values[name]
+	value, set := fm.lookupVar(name)
 	if !set {
 		return fallback
 	}
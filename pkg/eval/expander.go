@@ -105,13 +105,57 @@ func (e expanded) expand(ifs string) []word { return each(unquotedWord, split(e.
 func (e expanded) expandOneWord() word      { return unquotedWord(e.s) }
 func (e expanded) expandOneString() string  { return e.s }
 
-// Evaluation result of a compound expression.
+func (e expanded) delimited(ifs string) (bool, bool) { return splitDelimited(e.s, ifs) }
+
+// Implemented by expanders whose results may start or end with IFS
+// characters, in which case the result of field splitting is separated from
+// the text before or after it. For example, with x=" b ", "a"$x"c" expands to
+// three fields.
+type delimitedExpander interface {
+	delimited(ifs string) (start, end bool)
+}
+
+func delimited(e expander, ifs string) (start, end bool) {
+	if d, ok := e.(delimitedExpander); ok {
+		return d.delimited(ifs)
+	}
+	return false, false
+}
+
+// Evaluation result of a compound expression. This is also used for arguments
+// of substitution modifiers like ${x:-foo}, in which case it can be an element
+// of another compound.
 type compound struct{ elems []expander }
 
 func (c compound) expand(ifs string) []word {
-	return expandFromElems(nil, c.elems, func(e expander) []word {
-		return e.expand(ifs)
-	})
+	var words []word
+	// Whether the next element starts a new word.
+	newWord := false
+	for _, elem := range c.elems {
+		more := elem.expand(ifs)
+		start, end := delimited(elem, ifs)
+		if len(words) == 0 || newWord || start {
+			words = append(words, more...)
+		} else if len(more) > 0 {
+			words[len(words)-1] = appendWord(words[len(words)-1], more[0])
+			words = append(words, more[1:]...)
+		}
+		if len(more) > 0 {
+			newWord = end
+		} else {
+			newWord = newWord || ((start || end) && len(words) > 0)
+		}
+	}
+	return words
+}
+
+func (c compound) delimited(ifs string) (bool, bool) {
+	if len(c.elems) == 0 {
+		return false, false
+	}
+	start, _ := delimited(c.elems[0], ifs)
+	_, end := delimited(c.elems[len(c.elems)-1], ifs)
+	return start, end
 }
 
 func (c compound) expandOneWord() word     { return expandOneWordFromElems(c.elems) }
@@ -248,6 +292,26 @@ func split(s, ifs string, n int) []string {
 	return fields
 }
 
+// Returns whether the fields resulting from splitting s are separated from the
+// text before and after s.
+func splitDelimited(s, ifs string) (start, end bool) {
+	if s == "" {
+		return false, false
+	}
+	info := prepareIFS(ifs)
+	// Leading IFS whitespaces separate the fields from the text before, except
+	// when followed by a non-whitespace IFS character, which delimits an empty
+	// first field that is joined with the text before instead.
+	trimmed := strings.TrimLeft(s, info.whitespaces)
+	first, _ := utf8.DecodeRuneInString(trimmed)
+	start = len(trimmed) < len(s) && (trimmed == "" || !strings.ContainsRune(ifs, first))
+	// A trailing IFS character always separates the fields from the text
+	// after, since split doesn't produce a final empty field.
+	last, _ := utf8.DecodeLastRuneInString(s)
+	end = strings.ContainsRune(ifs, last)
+	return start, end
+}
+
 type ifsInfo struct {
 	whitespaces string
 	fieldDelim  *regexp.Regexp
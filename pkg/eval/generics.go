@@ -24,6 +24,15 @@ func cloneSlice[T any](s []T) []T {
 	return append([]T(nil), s...)
 }
 
+func contains[T comparable](s []T, v T) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
 func cloneMap[K comparable, V any](m map[K]V) map[K]V {
 	mm := make(map[K]V, len(m))
 	for k, v := range m {
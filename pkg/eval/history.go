@@ -0,0 +1,210 @@
+package eval
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/elves/posixsh/pkg/parse"
+)
+
+// POSIX requires the default value of $HISTSIZE to be at least 128.
+const defaultHistSize = 128
+
+// The command history, used by the fc command and the line editor. Frames of
+// the same shell share the same history, and so do subshells.
+//
+// Commands are only added by interactive shells, but the history is loaded
+// from $HISTFILE when first used in any shell. This is similar to ksh, and
+// makes it possible to use fc in scripts.
+type history struct {
+	// Whether the history has been loaded from $HISTFILE.
+	loaded bool
+	// Commands, oldest first. A command may span multiple lines, and never
+	// ends in a newline.
+	entries []string
+	// The number of entries[0]. Commands are numbered consecutively from 1,
+	// and keep their numbers when older commands are dropped.
+	first int
+	// Whether the last entry is the command being executed, which fc ignores,
+	// so that "fc -l -1" shows the command before the fc command itself.
+	current bool
+}
+
+func newHistory() *history {
+	return &history{first: 1}
+}
+
+// AddHistory adds code read by an interactive shell to the history, and
+// appends it to $HISTFILE. It should be called before the code is evaluated.
+//
+// Code consisting of only whitespaces is ignored. If the nolog option is on,
+// code containing function definitions is ignored too.
+func (ev *Evaler) AddHistory(code string) {
+	ev.frame().addHistory(code)
+}
+
+// History returns all commands in the history, oldest first.
+func (ev *Evaler) History() []string {
+	fm := ev.frame()
+	fm.loadHistory()
+	return cloneSlice(fm.history.entries)
+}
+
+func (fm *frame) addHistory(code string) {
+	code = strings.TrimRight(code, "\n")
+	if strings.TrimSpace(code) == "" {
+		return
+	}
+	if fm.options.has(nolog) && hasFnDef(code) {
+		return
+	}
+	fm.loadHistory()
+	h := fm.history
+	h.entries = append(h.entries, code)
+	h.current = true
+	if fm.trimHistory() {
+		fm.saveHistory()
+	} else {
+		fm.appendHistoryFile(code)
+	}
+}
+
+// Replaces the current command with code that it has run, which is what fc
+// does when re-executing commands. If there is no current command, the code is
+// not recorded, since only interactive shells add commands to the history.
+func (fm *frame) replaceCurrentHistory(code string) {
+	h := fm.history
+	if !h.current {
+		return
+	}
+	h.entries[len(h.entries)-1] = strings.TrimRight(code, "\n")
+	fm.saveHistory()
+}
+
+// Returns whether code contains any function definition at the top level.
+func hasFnDef(code string) bool {
+	n, _ := parse.Parse("", code)
+	for _, ao := range n.AndOrs {
+		for _, pl := range ao.Pipelines {
+			for _, c := range pl.Commands {
+				if _, ok := c.Data.(parse.FnDef); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (fm *frame) loadHistory() {
+	h := fm.history
+	if h.loaded {
+		return
+	}
+	h.loaded = true
+	path := fm.histFile()
+	if path == "" {
+		return
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fm.diag(nil, "cannot read history file: %v", err)
+		}
+		return
+	}
+	// The history file consists of commands terminated by newlines. Commands
+	// spanning multiple lines are reassembled by reading lines until they form
+	// complete code.
+	var entries []string
+	r := parse.NewReader(path, bytes.NewReader(bs), nil)
+	for {
+		code, err := r.NextCode()
+		if err != nil {
+			break
+		}
+		if entry := strings.TrimRight(code, "\n"); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	h.entries = append(entries, h.entries...)
+	if fm.trimHistory() {
+		fm.saveHistory()
+	}
+}
+
+// Drops the oldest entries beyond $HISTSIZE, and returns whether any entry was
+// dropped.
+func (fm *frame) trimHistory() bool {
+	h := fm.history
+	size := fm.histSize()
+	if len(h.entries) <= size {
+		return false
+	}
+	drop := len(h.entries) - size
+	h.entries = h.entries[drop:]
+	h.first += drop
+	if len(h.entries) == 0 {
+		h.current = false
+	}
+	return true
+}
+
+func (fm *frame) histFile() string {
+	path := fm.getVar("HISTFILE")
+	if path == "" {
+		// POSIX leaves the default unspecified; this is the same as ksh. Only
+		// interactive shells use the default, so that scripts don't touch the
+		// history of the user unless $HISTFILE is set explicitly.
+		home := fm.getVar("HOME")
+		if home == "" || !fm.options.has(interactive) {
+			return ""
+		}
+		path = filepath.Join(home, ".sh_history")
+	}
+	return fm.absPath(path)
+}
+
+func (fm *frame) histSize() int {
+	size, err := strconv.Atoi(fm.getVar("HISTSIZE"))
+	if err != nil || size < 0 {
+		return defaultHistSize
+	}
+	return size
+}
+
+func (fm *frame) appendHistoryFile(code string) {
+	path := fm.histFile()
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		fm.diag(nil, "cannot write history file: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(code + "\n"); err != nil {
+		fm.diag(nil, "cannot write history file: %v", err)
+	}
+}
+
+// Rewrites $HISTFILE with the entries in memory.
+func (fm *frame) saveHistory() {
+	path := fm.histFile()
+	if path == "" {
+		return
+	}
+	var sb strings.Builder
+	for _, entry := range fm.history.entries {
+		sb.WriteString(entry + "\n")
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		fm.diag(nil, "cannot write history file: %v", err)
+	}
+}
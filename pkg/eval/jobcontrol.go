@@ -0,0 +1,306 @@
+package eval
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Job control, enabled by the monitor option ("set -m").
+//
+// When job control is active, every pipeline run by the shell itself (as
+// opposed to a subshell) is a foreground job, and every asynchronous list is a
+// background job. External processes of a job are put in the job's own process
+// group, and the process group of a foreground job is made the foreground
+// process group of the controlling terminal, so that signals generated by the
+// terminal (like SIGTSTP from Ctrl-Z) are only sent to the job.
+//
+// When a foreground job is stopped, the shell stops waiting for it and adds it
+// to the job table. The job can be later resumed with fg or bg.
+//
+// Since subshells are run in the same process, the in-process parts of a job
+// (builtins, functions and subshells) can't be stopped by signals. When a job
+// is stopped, only its external processes are actually stopped; in-process
+// parts keep running until they finish or block on I/O with the stopped
+// processes. To make it possible for the shell to regain control when a
+// foreground job is stopped, a pipeline with multiple commands doesn't run its
+// last command in the current shell when job control is active, but in a
+// subshell like all the other commands.
+
+var terminal struct {
+	once sync.Once
+	// The controlling terminal, or nil if there is no usable one.
+	file *os.File
+	// Process group of the shell.
+	pgid int
+	// Process group of the foreground job, or 0 if the shell itself is in the
+	// foreground.
+	foreground atomic.Int64
+}
+
+// Returns the controlling terminal to use for job control, or nil if there is
+// none. The first call also moves the shell into its own process group if
+// necessary, and catches signals that would otherwise stop the shell.
+func jobControlTerminal() *os.File {
+	terminal.once.Do(func() {
+		f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return
+		}
+		fd := int(f.Fd())
+		fg, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+		if err != nil || fg != unix.Getpgrp() {
+			// We are not in the foreground, so we can't take over the terminal.
+			f.Close()
+			return
+		}
+		if pid := os.Getpid(); unix.Getpgrp() != pid {
+			// Like other shells, put the shell in its own process group.
+			if unix.Setpgid(0, 0) == nil {
+				tcsetpgrp(fd, pid)
+			}
+		}
+		terminal.pgid = unix.Getpgrp()
+		// The shell should not be stopped by Ctrl-Z or by reading from the
+		// terminal. We catch these signals instead of ignoring them, because
+		// ignored signals are inherited by child processes.
+		signal.Notify(make(chan os.Signal, 1), unix.SIGTSTP, unix.SIGTTIN)
+		terminal.file = f
+	})
+	return terminal.file
+}
+
+func tcsetpgrp(fd, pgid int) error {
+	// Calling tcsetpgrp from a background process group causes SIGTTOU to be
+	// sent to the entire process group unless it's ignored. We only ignore it
+	// temporarily, because ignored signals are inherited by child processes.
+	signal.Ignore(unix.SIGTTOU)
+	defer signal.Reset(unix.SIGTTOU)
+	return unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, pgid)
+}
+
+// Makes the given process group the foreground process group of the terminal.
+func setForeground(pgid int) {
+	if f := jobControlTerminal(); f != nil {
+		tcsetpgrp(int(f.Fd()), pgid)
+		terminal.foreground.Store(int64(pgid))
+	}
+}
+
+// Makes the shell the foreground process group of the terminal again.
+func reclaimTerminal() {
+	if f := jobControlTerminal(); f != nil {
+		tcsetpgrp(int(f.Fd()), terminal.pgid)
+		terminal.foreground.Store(0)
+	}
+}
+
+// Sends a signal to the foreground job, if there is one. Signals generated by
+// the terminal are only sent to the foreground process group, which the shell
+// is not in when a foreground job is running, so this is only needed for
+// signals sent to the shell explicitly.
+func signalForeground(sig syscall.Signal) {
+	if pgid := terminal.foreground.Load(); pgid != 0 {
+		unix.Kill(-int(pgid), sig)
+	}
+}
+
+// Starts an external process in the process group of the job, creating the
+// process group if necessary.
+func (j *job) startProcess(words []string, attr *os.ProcAttr) (*os.Process, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	attr.Sys = &syscall.SysProcAttr{Setpgid: true, Pgid: j.pgid}
+	proc, err := os.StartProcess(words[0], words, attr)
+	if err != nil {
+		return nil, err
+	}
+	if j.pgid == 0 {
+		j.pgid = proc.Pid
+		if j.foreground {
+			setForeground(j.pgid)
+		}
+	}
+	j.procs++
+	return proc, nil
+}
+
+// Waits for an external process of the job to terminate. If returnOnStop is
+// true, also returns as soon as the process is stopped, in which case the
+// second return value is true.
+func (j *job) waitProcess(proc *os.Process, returnOnStop bool) (int, bool) {
+	for {
+		var ws syscall.WaitStatus
+		_, err := syscall.Wait4(proc.Pid, &ws, syscall.WUNTRACED, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == nil && ws.Stopped() {
+			j.markStopped(ws.StopSignal())
+			if returnOnStop {
+				return StatusSignalBase + int(ws.StopSignal()), true
+			}
+			continue
+		}
+		proc.Release()
+		j.mu.Lock()
+		j.procs--
+		if j.procs == 0 {
+			// The process group ceases to exist when the last process exits;
+			// processes started later by the job need a new one.
+			j.pgid = 0
+		}
+		j.mu.Unlock()
+		if err != nil {
+			return StatusWaitError, false
+		}
+		return statusFromWaitStatus(ws), false
+	}
+}
+
+func (j *job) markStopped(sig syscall.Signal) {
+	j.mu.Lock()
+	j.stopped = true
+	j.stopSignal = sig
+	j.mu.Unlock()
+	touchJob(j)
+	select {
+	case j.stopCh <- struct{}{}:
+	default:
+	}
+}
+
+// Resumes a stopped job, either in the foreground or the background.
+func (j *job) resume(foreground bool) {
+	// Discard notifications of earlier stops.
+	select {
+	case <-j.stopCh:
+	default:
+	}
+	j.mu.Lock()
+	j.stopped = false
+	j.foreground = foreground
+	pgid := j.pgid
+	j.mu.Unlock()
+	touchJob(j)
+	if pgid != 0 {
+		if foreground {
+			setForeground(pgid)
+		}
+		syscall.Kill(-pgid, syscall.SIGCONT)
+	}
+}
+
+// Returns the PID of the process group leader of the job, or the PID used for
+// $! if the job doesn't have a process group.
+func (j *job) leader() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.pgid != 0 {
+		return j.pgid
+	}
+	return j.pid
+}
+
+// Waits for an external process started by fm. If fm owns a foreground job
+// and the process is stopped, the job is detached from fm.
+func (fm *frame) waitJobProcess(proc *os.Process) int {
+	j := fm.job
+	status, stopped := j.waitProcess(proc, j.ownedBy(fm))
+	if stopped {
+		fm.detachJob(func() int {
+			status, _ := j.waitProcess(proc, false)
+			return status
+		})
+	}
+	return status
+}
+
+// Runs f in a goroutine and waits for it to finish, or for the foreground job
+// owned by fm to be stopped. In the latter case, the job is detached from fm
+// and the second return value is true.
+func (fm *frame) runStoppable(f func() int) (int, bool) {
+	j := fm.job
+	done := make(chan int, 1)
+	go func() { done <- f() }()
+	select {
+	case status := <-done:
+		return status, false
+	case <-j.stopCh:
+		fm.detachJob(func() int { return <-done })
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return StatusSignalBase + int(j.stopSignal), true
+	}
+}
+
+// Called when the foreground job owned by fm has been stopped. Adds the job to
+// the job table, reports it as stopped, and arranges for wait to be called in
+// the background to get the status of the job. The rest of the current
+// command, if any, is run as a new foreground job.
+func (fm *frame) detachJob(wait func() int) {
+	j := fm.job
+	j.mu.Lock()
+	j.owner, j.foreground = nil, false
+	if j.pgid != 0 {
+		j.pid = j.pgid
+	} else {
+		j.pid = newPseudoPid()
+	}
+	j.mu.Unlock()
+	fm.jobs.add(j)
+	go func() {
+		j.status = wait()
+		close(j.done)
+	}()
+	reclaimTerminal()
+	cur, prev := fm.jobs.currentAndPrevious()
+	fmt.Fprint(fm.diagFile, formatJob(j, cur, prev, false))
+
+	newJ := newJob(j.text)
+	newJ.foreground, newJ.owner = true, fm
+	fm.job = newJ
+}
+
+// Formats a job in the format specified by POSIX for the jobs command.
+func formatJob(j, cur, prev *job, long bool) string {
+	mark := ' '
+	if j == cur {
+		mark = '+'
+	} else if j == prev {
+		mark = '-'
+	}
+	if long {
+		return fmt.Sprintf("[%d] %c %d %s %s\n", j.number, mark, j.leader(), j.state(), j.text)
+	}
+	return fmt.Sprintf("[%d] %c %s %s\n", j.number, mark, j.state(), j.text)
+}
+
+// ReportJobs writes the status of background jobs that have finished and
+// removes them from the job table. POSIX requires interactive shells to do
+// this before writing a prompt when job control is active; it's a no-op when
+// job control is not active.
+func (ev *Evaler) ReportJobs() {
+	fm := ev.frame()
+	if !fm.options.has(monitor) {
+		return
+	}
+	cur, prev := fm.jobs.currentAndPrevious()
+	for _, j := range fm.jobs.reap() {
+		fmt.Fprint(fm.diagFile, formatJob(j, cur, prev, false))
+	}
+}
+
+func statusFromWaitStatus(ws syscall.WaitStatus) int {
+	if ws.Exited() {
+		return ws.ExitStatus()
+	} else if ws.Signaled() {
+		return StatusSignalBase + int(ws.Signal())
+	}
+	return StatusWaitOther
+}
@@ -0,0 +1,318 @@
+package eval
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// A job, either started by an asynchronous list, or a foreground pipeline when
+// job control is active.
+//
+// Since subshells are run in the same process, every asynchronous list is run
+// in a goroutine, even when it consists of a single external command (in which
+// case the goroutine waits for the process). This allows external processes
+// and in-process subshells to be treated uniformly.
+type job struct {
+	// Job number used in job IDs like %1. Assigned when the job is added to the
+	// job table.
+	number int
+	// PID, which may be a pseudo PID. See (*frame).async for details.
+	pid int
+	// Source code of the job, without the terminating "&".
+	text string
+	// Closed when the job has finished.
+	done chan struct{}
+	// Exit status of the job. Only valid after done is closed.
+	status int
+
+	// The following fields are only used when job control is active. See
+	// jobcontrol.go for details.
+
+	mu sync.Mutex
+	// Process group ID of the job, or 0 if no external process of the job is
+	// running.
+	pgid int
+	// Number of running external processes in the process group.
+	procs int
+	// Whether the job should own the terminal.
+	foreground bool
+	// Whether the job is stopped, and the signal that stopped it.
+	stopped    bool
+	stopSignal syscall.Signal
+	// The frame running the job in the foreground, which will return as soon as
+	// the job is stopped. Nil for jobs run in the background.
+	owner *frame
+	// Receives a value whenever a process of the job has stopped.
+	stopCh chan struct{}
+	// Incremented every time the job is started or stopped; used for
+	// determining the current and previous jobs.
+	seq int64
+}
+
+func newJob(text string) *job {
+	return &job{text: text, done: make(chan struct{}), stopCh: make(chan struct{}, 1)}
+}
+
+func (j *job) ownedBy(fm *frame) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.owner == fm
+}
+
+func (j *job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *job) isStopped() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stopped
+}
+
+// Returns the state of the job in the format specified by POSIX for the jobs
+// command.
+func (j *job) state() string {
+	if j.finished() {
+		if j.status == 0 {
+			return "Done"
+		}
+		return fmt.Sprintf("Done(%d)", j.status)
+	} else if j.isStopped() {
+		return "Stopped"
+	}
+	return "Running"
+}
+
+// Table of all the jobs known to a shell. Frames of the same shell share the
+// same table, while subshells start with an empty table, because jobs started
+// by the parent shell are not children of the subshell.
+type jobTable struct {
+	mu sync.Mutex
+	// Ordered by job number.
+	jobs []*job
+	// Finished jobs removed by (*jobTable).reap without being waited for,
+	// oldest first. They are only kept for finding by PID, since POSIX
+	// requires "wait $pid" to work even after other jobs have been started.
+	reaped []*job
+	// Table of the parent shell if this is the table of a subshell. See
+	// (*jobTable).forJobsCmd.
+	parent *jobTable
+}
+
+func newJobTable(parent *jobTable) *jobTable { return &jobTable{parent: parent} }
+
+// Returns the table that should be consulted by the jobs command.
+//
+// POSIX allows "$(jobs)" to report jobs of the parent shell, and all of dash,
+// bash, ksh and zsh do so in order to support idioms like "kill $(jobs -p)".
+// We generalize this to all subshells that haven't started jobs themselves.
+func (jt *jobTable) forJobsCmd() *jobTable {
+	jt.mu.Lock()
+	empty := len(jt.jobs) == 0
+	jt.mu.Unlock()
+	if empty && jt.parent != nil {
+		return jt.parent.forJobsCmd()
+	}
+	return jt
+}
+
+var lastJobSeq atomic.Int64
+
+// Marks a job as the most recently used one.
+func touchJob(j *job) {
+	atomic.StoreInt64(&j.seq, lastJobSeq.Add(1))
+}
+
+func (jt *jobTable) add(j *job) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	// Use one more than the largest job number in use, like dash and bash.
+	j.number = 1
+	if len(jt.jobs) > 0 {
+		j.number = jt.jobs[len(jt.jobs)-1].number + 1
+	}
+	touchJob(j)
+	jt.jobs = append(jt.jobs, j)
+}
+
+func (jt *jobTable) remove(j *job) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	for i, j2 := range jt.jobs {
+		if j2 == j {
+			jt.jobs = append(jt.jobs[:i], jt.jobs[i+1:]...)
+			return
+		}
+	}
+	for i, j2 := range jt.reaped {
+		if j2 == j {
+			jt.reaped = append(jt.reaped[:i], jt.reaped[i+1:]...)
+			return
+		}
+	}
+}
+
+// Maximum number of reaped jobs whose statuses are remembered. POSIX requires
+// at least CHILD_MAX, which is 25 in the minimum limits of POSIX.
+const maxReapedJobs = 1024
+
+// Removes finished jobs from the table and returns them. Without this, the
+// table of a script that keeps starting asynchronous lists without waiting for
+// them would grow indefinitely.
+func (jt *jobTable) reap() []*job {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	var reaped []*job
+	running := jt.jobs[:0]
+	for _, j := range jt.jobs {
+		if j.finished() {
+			reaped = append(reaped, j)
+		} else {
+			running = append(running, j)
+		}
+	}
+	jt.jobs = running
+	jt.reaped = append(jt.reaped, reaped...)
+	if n := len(jt.reaped) - maxReapedJobs; n > 0 {
+		jt.reaped = jt.reaped[n:]
+	}
+	return reaped
+}
+
+// Returns a snapshot of all the jobs.
+func (jt *jobTable) all() []*job {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	return cloneSlice(jt.jobs)
+}
+
+// Returns the current job and the previous job, either of which may be nil.
+//
+// POSIX specifies that the current job should be a stopped job if there is
+// any. We use the most recently stopped job in that case, and the most
+// recently started job otherwise. The previous job is the job that would
+// become the current job if the current job were removed.
+func (jt *jobTable) currentAndPrevious() (cur, prev *job) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	return currentAndPrevious(jt.jobs)
+}
+
+func currentAndPrevious(jobs []*job) (cur, prev *job) {
+	sorted := cloneSlice(jobs)
+	sort.SliceStable(sorted, func(i, k int) bool {
+		si, sk := sorted[i].isStopped(), sorted[k].isStopped()
+		if si != sk {
+			return si
+		}
+		return atomic.LoadInt64(&sorted[i].seq) > atomic.LoadInt64(&sorted[k].seq)
+	})
+	if len(sorted) > 0 {
+		cur = sorted[0]
+	}
+	if len(sorted) > 1 {
+		prev = sorted[1]
+	}
+	return cur, prev
+}
+
+type badJobIDError struct{ id string }
+
+func (err badJobIDError) Error() string { return "invalid job ID or PID: " + err.id }
+
+// Finds the job designated by a PID or a job ID (like %1). Returns nil if the
+// argument is valid but no such job is known.
+//
+// In addition to the forms of job ID specified by POSIX in 3.204 "Job Control
+// Job ID", a bare "%" is also supported as an alias of "%%", like in all of
+// dash, bash, ksh and zsh.
+func (jt *jobTable) find(id string) (*job, error) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	if !strings.HasPrefix(id, "%") {
+		pid, err := strconv.Atoi(id)
+		if err != nil || pid <= 0 {
+			return nil, badJobIDError{id}
+		}
+		for _, j := range jt.jobs {
+			if j.pid == pid {
+				return j, nil
+			}
+		}
+		// PIDs may be reused, so look for the most recent reaped job.
+		for i := len(jt.reaped) - 1; i >= 0; i-- {
+			if jt.reaped[i].pid == pid {
+				return jt.reaped[i], nil
+			}
+		}
+		return nil, nil
+	}
+	spec := id[1:]
+	switch {
+	case spec == "" || spec == "%" || spec == "+":
+		cur, _ := currentAndPrevious(jt.jobs)
+		return cur, nil
+	case spec == "-":
+		_, prev := currentAndPrevious(jt.jobs)
+		return prev, nil
+	case strings.HasPrefix(spec, "?"):
+		return jt.findUnique(id, func(j *job) bool {
+			return strings.Contains(j.text, spec[1:])
+		})
+	default:
+		if n, err := strconv.Atoi(spec); err == nil {
+			for _, j := range jt.jobs {
+				if j.number == n {
+					return j, nil
+				}
+			}
+			return nil, nil
+		}
+		return jt.findUnique(id, func(j *job) bool {
+			return strings.HasPrefix(j.text, spec)
+		})
+	}
+}
+
+type ambiguousJobIDError struct{ id string }
+
+func (err ambiguousJobIDError) Error() string { return "ambiguous job ID: " + err.id }
+
+// Must be called with jt.mu held.
+func (jt *jobTable) findUnique(id string, f func(*job) bool) (*job, error) {
+	var found *job
+	for _, j := range jt.jobs {
+		if f(j) {
+			if found != nil {
+				return nil, ambiguousJobIDError{id}
+			}
+			found = j
+		}
+	}
+	return found, nil
+}
+
+// Pseudo PIDs are used for $! when an asynchronous list is run within the same
+// process. They start from a value larger than the maximum PID on Linux (2^22)
+// and most other Unix systems, so that they don't collide with the PIDs of
+// actual processes.
+//
+// Pseudo PIDs are shared by all shells in the process, so that PIDs are unique
+// even across different Evaler instances.
+var lastPseudoPid atomic.Int64
+
+const pseudoPidBase = 1 << 22
+
+func newPseudoPid() int {
+	return pseudoPidBase + int(lastPseudoPid.Add(1))
+}
@@ -0,0 +1,110 @@
+package eval
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/elves/posixsh/pkg/parse"
+)
+
+// Support for the noexec option ("set -n"), which turns the shell into a
+// syntax checker.
+//
+// POSIX specifies that when noexec is on, the shell reads commands but does not
+// execute them. Code is parsed one complete command at a time, so after
+// "set -n" takes effect, each command read afterwards is parsed and checked
+// instead of executed. Parsing normally stops at the first syntax error; with
+// noexec on, it resumes at the line after the erroneous command and keeps
+// reporting errors, so that "sh -n script" reports as many of them as it can.
+//
+// To make the option more useful, we also follow "." commands whose arguments
+// are literal, and check the syntax of the files they source. None of dash,
+// bash, ksh and zsh do this.
+
+// Checks the syntax of code that is not executed because of noexec.
+func (fm *frame) check(n parse.Node) {
+	fm.checkNode(n, make(map[string]bool))
+}
+
+func (fm *frame) checkNode(n parse.Node, visited map[string]bool) {
+	if c, ok := n.(*parse.Command); ok {
+		if data, ok := c.Data.(parse.Simple); ok && len(data.Words) >= 2 {
+			name, ok1 := literalWord(data.Words[0])
+			arg, ok2 := literalWord(data.Words[1])
+			if ok1 && ok2 && name == "." {
+				fm.checkSourced(arg, visited)
+			}
+		}
+	}
+	for _, child := range n.Children() {
+		fm.checkNode(child, visited)
+	}
+}
+
+// Checks the syntax of a file sourced by ".". Errors finding or reading the
+// file are ignored, since they would only be errors when the file is actually
+// sourced.
+func (fm *frame) checkSourced(arg string, visited map[string]bool) {
+	path, ok, _ := lookPath(arg, fm.wd, fm.getVar("PATH"), 0)
+	if !ok || visited[path] {
+		return
+	}
+	visited[path] = true
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := parse.NewReader(arg, bufio.NewReader(f), nil)
+	for {
+		n, err := r.Next()
+		if err == io.EOF {
+			return
+		} else if _, ok := err.(parse.Error); ok {
+			PrintSyntaxErrors(fm.diagFile, arg, err)
+		} else if err != nil {
+			return
+		}
+		fm.checkNode(n, visited)
+	}
+}
+
+// Returns whether commands should be checked instead of executed.
+func (fm *frame) checking() bool {
+	// POSIX allows interactive shells to ignore noexec. We do so like bash;
+	// otherwise nothing, not even "set +n", could be run after "set -n".
+	return fm.options.has(noexec) && !fm.options.has(interactive)
+}
+
+// Returns the value of a word if it doesn't contain any expansion, tilde prefix
+// or glob character.
+func literalWord(cp *parse.Compound) (string, bool) {
+	if cp.TildePrefix != "" {
+		return "", false
+	}
+	var sb strings.Builder
+	for _, pr := range cp.Parts {
+		switch pr.Type {
+		case parse.BarewordPrimary:
+			if strings.ContainsAny(pr.Value, "*?[") {
+				return "", false
+			}
+			sb.WriteString(pr.Value)
+		case parse.EscapedPrimary, parse.SingleQuotedPrimary:
+			sb.WriteString(pr.Value)
+		case parse.DoubleQuotedPrimary:
+			for _, seg := range pr.Segments {
+				expansion, text := seg.Segment()
+				if expansion != nil {
+					return "", false
+				}
+				sb.WriteString(text)
+			}
+		default:
+			return "", false
+		}
+	}
+	return sb.String(), true
+}
@@ -7,19 +7,25 @@ import (
 
 type options uint32
 
-// Omitted: ignoreeof, nolog, vi. These are all related to interactive mode and
-// unlikely to be found in scripts.
 const (
 	allexport options = 1 << iota
+	emacs
 	errexit
+	ignoreeof
 	monitor
 	noclobber
 	noglob
 	noexec
+	nolog
 	notify
 	nounset
+	pipefail
 	verbose
+	vi
 	xtrace
+	// Not a real option: it is set by (*Evaler).SetInteractive, and can't be
+	// changed with set.
+	interactive
 )
 
 // Omitted: -h. Dash doesn't have this option, and bash and zsh use -h for
@@ -41,23 +47,51 @@ const optionLetters = "abCefmnuvx"
 
 var optionByName = map[string]options{
 	"allexport": allexport,
+	"emacs":     emacs,
 	"errexit":   errexit,
+	"ignoreeof": ignoreeof,
 	"monitor":   monitor,
 	"noclobber": noclobber,
 	"noglob":    noglob,
 	"noexec":    noexec,
+	"nolog":     nolog,
 	"notify":    notify,
 	"nounset":   nounset,
+	"pipefail":  pipefail,
 	"verbose":   verbose,
+	"vi":        vi,
 	"xtrace":    xtrace,
 }
 
+// OptionName returns the long name of the option with the given letter, like
+// "errexit" for 'e'.
+func OptionName(letter byte) (string, bool) {
+	bit, ok := optionByLetter[letter]
+	if !ok {
+		return "", false
+	}
+	for name, b := range optionByName {
+		if b == bit {
+			return name, true
+		}
+	}
+	return "", false
+}
+
 func (o options) has(bit options) bool {
 	return o&bit != 0
 }
 
 func (o options) with(bit options, on bool) options {
 	if on {
+		// The emacs and vi options select the key bindings of the line editor,
+		// so at most one of them can be on.
+		switch bit {
+		case emacs:
+			o &^= vi
+		case vi:
+			o &^= emacs
+		}
 		return o | bit
 	} else {
 		return o &^ bit
@@ -100,5 +134,10 @@ func (o options) dash() string {
 			sb.WriteByte(letter)
 		}
 	}
+	// POSIX doesn't specify this, but all of dash, bash, ksh and zsh include
+	// "i" in $- in interactive shells, and scripts rely on it to detect them.
+	if o.has(interactive) {
+		sb.WriteByte('i')
+	}
 	return sb.String()
 }
@@ -0,0 +1,61 @@
+package eval
+
+import (
+	"os"
+
+	"github.com/elves/posixsh/pkg/parse"
+)
+
+// PS1 returns the expanded value of $PS1, the primary prompt of interactive
+// shells.
+func (ev *Evaler) PS1() string {
+	return ev.frame().ps1()
+}
+
+// PS2 returns the expanded value of $PS2, the prompt for continuation lines in
+// interactive shells.
+func (ev *Evaler) PS2() string {
+	return ev.frame().ps2()
+}
+
+// Default values of the prompt variables are specified in section 2.5.4 "Shell
+// variables".
+
+func (fm *frame) ps1() string {
+	if os.Geteuid() == 0 {
+		return fm.expandVar("PS1", "# ")
+	}
+	return fm.expandVar("PS1", "$ ")
+}
+
+func (fm *frame) ps2() string { return fm.expandVar("PS2", "> ") }
+
+func (fm *frame) ps4() string { return fm.expandVar("PS4", "+ ") }
+
+// Returns the value of a prompt variable or $ENV, or the fallback if it's unset,
+// after performing parameter expansion, command substitution and arithmetic
+// expansion on it. POSIX only requires parameter expansion, but dash, bash, ksh
+// and zsh all perform the other two expansions too.
+//
+// The expansion doesn't affect $?, and isn't traced when xtrace is on (which
+// would cause infinite recursion with $PS4). If the value can't be parsed or
+// expanded, it is used as is.
+func (fm *frame) expandVar(name, fallback string) string {
+	value := fm.getVarOr(name, fallback)
+	n, err := parse.ParseText(name, value)
+	if err != nil {
+		return value
+	}
+	savedOptions := fm.options
+	savedStatus, savedCmdSubstStatus := fm.lastPipelineStatus, fm.lastCmdSubstStatus
+	fm.options = fm.options.with(xtrace, false)
+	defer func() {
+		fm.options = savedOptions
+		fm.lastPipelineStatus, fm.lastCmdSubstStatus = savedStatus, savedCmdSubstStatus
+	}()
+	exp, ok := fm.segments(n.Segments)
+	if !ok {
+		return value
+	}
+	return exp.expandOneString()
+}
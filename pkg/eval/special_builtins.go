@@ -6,7 +6,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/elves/posixsh/pkg/parse"
 	"golang.org/x/sys/unix"
 )
 
@@ -19,9 +18,8 @@ var specialBuiltins = map[string]func(*frame, []string) (int, bool){
 	"break":    breakCmd,
 	":":        colonCmd,
 	"continue": continueCmd,
-	// "." and "eval" are set in init
+	// ".", "eval" and "exit" are set in init
 	"exec":     execCmd,
-	"exit":     exitCmd,
 	"export":   exportCmd,
 	"readonly": readonlyCmd,
 	"return":   returnCmd,
@@ -37,6 +35,7 @@ func init() {
 	// initialize them here to avoid dependency cycle.
 	specialBuiltins["."] = dotCmd
 	specialBuiltins["eval"] = evalCmd
+	specialBuiltins["exit"] = exitCmd
 }
 
 func breakCmd(fm *frame, args []string) (int, bool) {
@@ -89,26 +88,28 @@ func dotCmd(fm *frame, args []string) (int, bool) {
 	}
 	path, ok, _ := lookPath(args[0], fm.wd, fm.getVar("PATH"), 0)
 	if !ok {
-		fm.diagSpecialCommand("not found: %v\n", args[0])
+		fm.diagSpecialCommand("not found: %v", args[0])
 		return StatusFileToSourceNotFound, false
 	}
+	return fm.source(args[0], path, args[1:])
+}
+
+// Sources the file at path, which has already been looked up. The name is used
+// in diagnostic messages. This implements the "." command, and is also used
+// for sourcing startup files.
+func (fm *frame) source(name, path string, args []string) (int, bool) {
 	bs, err := os.ReadFile(path)
 	if err != nil {
-		fm.diagSpecialCommand("cannot read %v: %v\n", args[0], err)
+		fm.diagSpecialCommand("cannot read %v: %v", name, err)
 		return StatusFileToSourceNotReadable, false
 	}
 	code := string(bs)
-	n, err := parse.Parse(code)
-	if err != nil {
-		fm.diagSpecialCommand("syntax error:", err)
-		return StatusSyntaxError, false
-	}
 	// A file sourced by "." can use the return command, like in a function
 	// call. All of bash, ksh and zsh (but not dash) extend this similarity
 	// further by setting the positional arguments within the execution. This is
 	// not specified by POSIX, but we do that too.
-	return fm.callFuncLike(args[1:], func() (int, bool) {
-		return fm.chunk(n)
+	return fm.callFuncLike(args, func() (int, bool) {
+		return fm.evalCode(name, code, fm.chunk)
 	})
 }
 
@@ -117,28 +118,53 @@ func evalCmd(fm *frame, args []string) (int, bool) {
 	if strings.Trim(code, " \t\n") == "" {
 		return 0, true
 	}
-	n, err := parse.Parse(code)
-	if err != nil {
-		fm.diagSpecialCommand("syntax error:", err)
-		return StatusSyntaxError, false
-	}
-	return fm.chunk(n)
+	return fm.evalCode("eval", code, fm.chunk)
 }
 
-func execCmd(*frame, []string) (int, bool) {
-	// TODO
-	return 0, true
+func execCmd(fm *frame, args []string) (int, bool) {
+	if len(args) == 0 {
+		// Redirections have been made permanent by (*frame).runSimple.
+		return 0, true
+	}
+	// POSIX specifies that exec runs a utility rather than a function or a
+	// builtin; dash, bash, ksh and zsh all only look for external commands.
+	//
+	// Since subshells are not separate processes, exec in a subshell runs the
+	// command and then exits the subshell, which is indistinguishable from
+	// replacing the process of a subshell.
+	if fm.subshell {
+		status, _ := fm.runExternal(args, fm.currentCommand, func(int) {})
+		fm.execAbort = true
+		return status, false
+	}
+	// POSIX specifies that a non-interactive shell exits when exec fails.
+	path, status := fm.lookCommand(args[0])
+	if status != 0 {
+		return status, false
+	}
+	args[0] = path
+	err := fm.execProcess(args)
+	fm.diagSpecialCommand("exec: %v", err)
+	return StatusCommandNotExecutable, false
 }
 
 func exitCmd(fm *frame, args []string) (int, bool) {
 	// POSIX doesn't specify the status should be when exit is called without an
 	// argument, but all of dash, bash, ksh and zsh use $?; we follow this
-	// behavior.
-	status, ok := parseOneInt(fm, args, fm.lastPipelineStatus)
+	// behavior. Within a trap action, POSIX does specify that $? before the
+	// trap action should be used.
+	fallback := fm.lastPipelineStatus
+	if fm.traps.inAction {
+		fallback = fm.traps.savedStatus
+	}
+	status, ok := parseOneInt(fm, args, fallback)
 	if !ok {
 		return StatusBadCommandLine, false
 	}
-	return status, false
+	if !fm.subshell {
+		fm.exited = true
+	}
+	return fm.runExitTrap(status), false
 }
 
 func exportCmd(fm *frame, args []string) (int, bool) {
@@ -311,9 +337,33 @@ func timesCmd(fm *frame, args []string) (int, bool) {
 	return 0, true
 }
 
-func trapCmd(*frame, []string) (int, bool) {
-	// TODO
-	return 0, true
+func trapCmd(fm *frame, args []string) (int, bool) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fm.traps.print(fm.files[1])
+		return 0, true
+	}
+	// POSIX specifies that if the first operand is an unsigned integer, all
+	// operands are conditions to reset. When there is only one operand, we
+	// also treat it as a condition to reset, like bash, ksh and zsh.
+	action, conds, reset := args[0], args[1:], args[0] == "-"
+	if _, err := strconv.ParseUint(args[0], 10, 0); err == nil || len(args) == 1 {
+		action, conds, reset = "", args, true
+	}
+	// POSIX specifies that invalid conditions are not fatal errors.
+	status := 0
+	for _, s := range conds {
+		cond, ok := parseCondition(s)
+		if !ok {
+			fm.diagSpecialCommand("invalid condition: %v", s)
+			status = 1
+			continue
+		}
+		fm.traps.set(cond, action, reset)
+	}
+	return status, true
 }
 
 func unsetCmd(fm *frame, args []string) (int, bool) {
@@ -336,6 +386,7 @@ func unsetCmd(fm *frame, args []string) (int, bool) {
 		// unset variables.
 		for _, name := range args {
 			delete(fm.variables.values, name)
+			fm.varChanged(name)
 		}
 	}
 	return 0, true
@@ -383,11 +434,9 @@ func formatTimevalForTimes(t unix.Timeval) string {
 }
 
 func (fm *frame) diagSpecialCommand(format string, args ...any) {
-	// TODO: Incorporate range information.
-	fmt.Fprintf(fm.diagFile, format+"\n", args...)
+	fm.diagCommand(format, args...)
 }
 
 func (fm *frame) badCommandLine(format string, args ...any) {
-	// TODO: Incorporate range information.
-	fmt.Fprintf(fm.diagFile, "bad command line option: "+format+"\n", args...)
+	fm.diagCommand("bad command line option: "+format, args...)
 }
@@ -0,0 +1,58 @@
+package eval
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// SystemProfile is the path of the system-wide profile sourced by login shells.
+// It can be changed by tests.
+var SystemProfile = "/etc/profile"
+
+// SourceProfiles sources SystemProfile and then $HOME/.profile, which login
+// shells do on startup. Files that don't exist are skipped.
+//
+// The files are sourced like with the "." command, so the return values have
+// the same meaning as those of EvalChunk.
+func (ev *Evaler) SourceProfiles() (int, bool) {
+	fm := ev.frame()
+	status, ok := fm.sourceIfExists(SystemProfile)
+	if !ok {
+		return status, false
+	}
+	if home := fm.getVar("HOME"); home != "" {
+		return fm.sourceIfExists(filepath.Join(home, ".profile"))
+	}
+	return status, true
+}
+
+// SourceEnv sources the file named by $ENV, which interactive shells do on
+// startup. The value of $ENV is expanded like $PS1, and a file that doesn't
+// exist is skipped.
+//
+// The file is sourced like with the "." command, so the return values have the
+// same meaning as those of EvalChunk.
+func (ev *Evaler) SourceEnv() (int, bool) {
+	// POSIX requires $ENV to be ignored when the real and effective user IDs
+	// or group IDs differ.
+	if os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid() {
+		return 0, true
+	}
+	fm := ev.frame()
+	path := fm.expandVar("ENV", "")
+	if path == "" {
+		return 0, true
+	}
+	return fm.sourceIfExists(path)
+}
+
+func (fm *frame) sourceIfExists(name string) (int, bool) {
+	path := fm.absPath(name)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return 0, true
+	}
+	// Unlike "." without arguments, keep the positional parameters.
+	return fm.source(name, path, fm.arguments[1:])
+}
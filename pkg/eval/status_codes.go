@@ -63,5 +63,6 @@ const (
 	// Specified by POSIX.
 	StatusCommandNotExecutable = 126
 	StatusCommandNotFound      = 127
+	StatusWaitUnknownJob       = 127
 	StatusSignalBase           = 128
 )
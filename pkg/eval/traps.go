@@ -0,0 +1,267 @@
+package eval
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/elves/posixsh/pkg/parse"
+	"golang.org/x/sys/unix"
+)
+
+// The condition for the EXIT trap. POSIX allows "0" to be used as an alias of
+// "EXIT", so 0 is a natural choice.
+const exitCondition syscall.Signal = 0
+
+// Traps set by the trap command. Frames of the same shell share the same table,
+// while subshells get a new table, since POSIX requires traps that are not
+// being ignored to be reset to the default action in subshells.
+//
+// Signal dispositions are a property of the process, and subshells are run in
+// the same process, so only the table of the shell itself (as opposed to a
+// subshell) actually receives signals. Traps on signals set in a subshell are
+// recorded, but never triggered.
+type trapTable struct {
+	// Actions keyed by conditions. An empty action means that the condition is
+	// ignored.
+	actions map[syscall.Signal]string
+	// Actions of the parent shell if this table belongs to a subshell and the
+	// subshell hasn't modified any trap yet. POSIX requires the trap command to
+	// print these actions in that case, so that "traps=$(trap)" works.
+	parentActions map[syscall.Signal]string
+	// Receives signals that have actions. Nil if this table belongs to a
+	// subshell.
+	sigCh chan os.Signal
+	// Set when a trap action is being run, in which case savedStatus stores the
+	// value of $? before the trap action. Used by the exit command.
+	inAction    bool
+	savedStatus int
+	// Receives signals in interactiveSignals when the shell is interactive.
+	// Nil otherwise.
+	interactiveCh chan os.Signal
+	// Set when an interactive shell receives SIGINT, and checked between
+	// commands to abort the evaluation. Shared with synchronous subshells, and
+	// nil if the shell is not interactive or in asynchronous lists, which are
+	// not interrupted.
+	interrupted *atomic.Bool
+}
+
+// Signals that don't terminate interactive shells, as required by POSIX. They
+// are caught instead of ignored, because ignored signals are inherited by
+// child processes.
+var interactiveSignals = []os.Signal{unix.SIGINT, unix.SIGQUIT, unix.SIGTERM}
+
+// CatchInteractiveSignals makes the shell survive SIGINT, SIGQUIT and SIGTERM
+// when they have no traps, like interactive shells should. SIGINT is passed on
+// to the foreground job, if any, and aborts the current evaluation, so that
+// the shell can go back to the prompt.
+func (ev *Evaler) CatchInteractiveSignals() {
+	t := ev.frame().traps
+	if t.interactiveCh != nil {
+		return
+	}
+	t.interactiveCh = make(chan os.Signal, 16)
+	t.interrupted = new(atomic.Bool)
+	for _, sig := range interactiveSignals {
+		if _, hasTrap := t.actions[sig.(syscall.Signal)]; !hasTrap {
+			signal.Notify(t.interactiveCh, sig)
+		}
+	}
+	go func() {
+		for sig := range t.interactiveCh {
+			if sig == unix.SIGINT {
+				t.interrupt()
+				signalForeground(unix.SIGINT)
+			}
+		}
+	}()
+}
+
+func newTrapTable() *trapTable {
+	return &trapTable{
+		actions: make(map[syscall.Signal]string),
+		sigCh:   make(chan os.Signal, 16),
+	}
+}
+
+func (t *trapTable) cloneForSubshell() *trapTable {
+	actions := make(map[syscall.Signal]string)
+	for cond, action := range t.actions {
+		if action == "" {
+			actions[cond] = action
+		}
+	}
+	return &trapTable{actions: actions, parentActions: t.actions,
+		interrupted: t.interrupted}
+}
+
+// Records that the current evaluation has been interrupted, if the shell is
+// interactive.
+func (t *trapTable) interrupt() {
+	if t.interrupted != nil {
+		t.interrupted.Store(true)
+	}
+}
+
+// Sets the action for a condition, or resets the condition to the default
+// action if reset is true.
+func (t *trapTable) set(cond syscall.Signal, action string, reset bool) {
+	t.parentActions = nil
+	if reset {
+		delete(t.actions, cond)
+	} else {
+		t.actions[cond] = action
+	}
+	if cond == exitCondition || t.sigCh == nil {
+		return
+	}
+	switch {
+	case reset:
+		signal.Reset(cond)
+		if t.interactiveCh != nil && isInteractiveSignal(cond) {
+			signal.Notify(t.interactiveCh, cond)
+		}
+	case action == "":
+		signal.Ignore(cond)
+	default:
+		signal.Notify(t.sigCh, cond)
+	}
+}
+
+func isInteractiveSignal(sig syscall.Signal) bool {
+	for _, s := range interactiveSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a condition, which may be "EXIT", a signal name with or without the
+// "SIG" prefix, or a signal number.
+func parseCondition(s string) (syscall.Signal, bool) {
+	if s == "EXIT" {
+		return exitCondition, true
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		sig := syscall.Signal(n)
+		return sig, sig == exitCondition || unix.SignalName(sig) != ""
+	}
+	if !strings.HasPrefix(s, "SIG") {
+		s = "SIG" + s
+	}
+	sig := unix.SignalNum(s)
+	return sig, sig != 0
+}
+
+// Formats a condition in the form used when printing traps, which is the same
+// as the form used by dash and bash.
+func formatCondition(cond syscall.Signal) string {
+	if cond == exitCondition {
+		return "EXIT"
+	}
+	return strings.TrimPrefix(unix.SignalName(cond), "SIG")
+}
+
+// Writes commands that can be used to recreate the traps.
+func (t *trapTable) print(out *os.File) {
+	actions := t.actions
+	if t.parentActions != nil {
+		actions = t.parentActions
+	}
+	conds := make([]syscall.Signal, 0, len(actions))
+	for cond := range actions {
+		conds = append(conds, cond)
+	}
+	// EXIT comes first since it's 0.
+	sort.Slice(conds, func(i, j int) bool { return conds[i] < conds[j] })
+	for _, cond := range conds {
+		// Always use single quotes like dash and bash; using quote would
+		// print an empty action as nothing.
+		fmt.Fprintf(out, "trap -- '%s' %s\n",
+			strings.ReplaceAll(actions[cond], "'", `'\''`), formatCondition(cond))
+	}
+}
+
+// Runs the actions of the traps for all the signals that have been received.
+// Called between commands; POSIX leaves it unspecified exactly when trap
+// actions are run, as long as it happens after the foreground command that was
+// running when the signal was received has completed.
+//
+// This also aborts the evaluation if an interactive shell has received SIGINT
+// and there is no trap for it.
+func (fm *frame) runPendingTraps() (int, bool) {
+	t := fm.traps
+	if t.interrupted != nil && t.interrupted.Load() {
+		if _, hasTrap := t.actions[unix.SIGINT]; !hasTrap {
+			return StatusSignalBase + int(unix.SIGINT), false
+		}
+	}
+	if t.sigCh == nil {
+		return 0, true
+	}
+	for {
+		select {
+		case sig := <-t.sigCh:
+			// The trap may have been changed after the signal was received.
+			action := t.actions[sig.(syscall.Signal)]
+			if action == "" {
+				continue
+			}
+			saved := fm.lastPipelineStatus
+			status, ok := fm.runTrapAction(action)
+			if !ok {
+				return status, false
+			}
+			// POSIX requires $? to be restored after the trap action.
+			fm.lastPipelineStatus = saved
+		default:
+			return 0, true
+		}
+	}
+}
+
+// Runs the action of the EXIT trap if there is one, and returns the status the
+// shell should exit with. The trap is removed before running the action, so
+// that it is run at most once.
+func (fm *frame) runExitTrap(status int) int {
+	action := fm.traps.actions[exitCondition]
+	delete(fm.traps.actions, exitCondition)
+	if action == "" {
+		return status
+	}
+	fm.lastPipelineStatus = status
+	trapStatus, ok := fm.runTrapAction(action)
+	if !ok {
+		// The action called exit or encountered a fatal error; the status of
+		// that becomes the status of the shell.
+		return trapStatus
+	}
+	return status
+}
+
+func (fm *frame) runTrapAction(action string) (int, bool) {
+	n, err := parse.ParseWithAliases("trap", action, fm.alias)
+	if err != nil {
+		PrintSyntaxErrors(fm.diagFile, "trap", err)
+		return StatusSyntaxError, true
+	}
+	t := fm.traps
+	inAction, savedStatus := t.inAction, t.savedStatus
+	t.inAction, t.savedStatus = true, fm.lastPipelineStatus
+	defer func() { t.inAction, t.savedStatus = inAction, savedStatus }()
+	return fm.chunk(n)
+}
+
+// RunExitTrap runs the action of the EXIT trap, if any, and returns the status
+// the shell should exit with, which is normally the status passed in. It should
+// be called when the shell is about to exit; it is a no-op if the EXIT trap has
+// already been run by the exit command.
+func (ev *Evaler) RunExitTrap(status int) int {
+	return ev.frame().runExitTrap(status)
+}
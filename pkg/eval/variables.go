@@ -27,6 +27,8 @@ func initVariablesFromEnv(entries []string) variables {
 		v.exported.add(name)
 	}
 	v.values["PPID"] = strconv.Itoa(os.Getppid())
+	// Specified by POSIX.
+	v.values["OPTIND"] = "1"
 	v.exported.add("PWD")
 	return v
 }
@@ -55,7 +57,7 @@ type unsetError struct{ name string }
 func (err unsetError) Error() string { return err.name + " is unset" }
 
 func (fm *frame) GetVar(name string) (string, error) {
-	value, ok := fm.variables.values[name]
+	value, ok := fm.lookupVar(name)
 	if !ok && fm.options.has(nounset) {
 		return value, unsetError{name}
 	}
@@ -74,5 +76,19 @@ func (fm *frame) SetVar(name, value string) error {
 		fm.variables.exported.add(name)
 	}
 	fm.variables.values[name] = value
+	fm.varChanged(name)
 	return nil
 }
+
+// Updates state that depends on special variables. Called after a variable is
+// set or unset.
+func (fm *frame) varChanged(name string) {
+	switch name {
+	case "OPTIND":
+		fm.getoptsState = getoptsState{}
+	case "PATH":
+		for name := range fm.hashed {
+			delete(fm.hashed, name)
+		}
+	}
+}
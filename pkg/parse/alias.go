@@ -0,0 +1,128 @@
+package parse
+
+import (
+	"sort"
+	"strings"
+)
+
+// Aliases looks up the definition of an alias by its name, used for alias
+// substitution.
+type Aliases func(name string) (string, bool)
+
+// Words that are not subject to alias substitution when they appear as the
+// command word, where they are recognized as reserved words.
+var reservedWords = map[string]bool{
+	"!": true, "{": true, "}": true, "case": true, "do": true, "done": true,
+	"elif": true, "else": true, "esac": true, "fi": true, "for": true,
+	"if": true, "in": true, "then": true, "until": true, "while": true,
+}
+
+// An alias whose text is being parsed, which ends at text[end].
+type activeAlias struct {
+	name string
+	end  int
+}
+
+// Performs alias substitution on the word at the current position if it is an
+// unquoted bareword that is the name of an alias, and returns whether a
+// substitution has been performed. This should only be called where a command
+// word may appear.
+//
+// POSIX specifies alias substitution in terms of tokens: the token of the alias
+// name is replaced by the tokens of its text. This is implemented by replacing
+// the alias name with its text in p.text, so the text is parsed like any other
+// code and can contain any syntax.
+//
+// An alias is not substituted again while its text is being parsed, which
+// prevents infinite recursion when, for example, the text of the alias "ls" is
+// "ls -F".
+func (p *parser) substituteAlias(opt nodeOpt) bool {
+	if p.aliases == nil {
+		return false
+	}
+	p.pruneActiveAliases()
+	name := p.aliasName(opt)
+	if name == "" || reservedWords[name] || p.aliasActive(name) {
+		return false
+	}
+	def, ok := p.aliases(name)
+	if !ok {
+		return false
+	}
+	// Line continuations have been removed from the rest of the text; do the
+	// same for the text of the alias. Unlike elsewhere, this also removes \
+	// and newline inside single quotes, which is a rare case.
+	def = strings.ReplaceAll(def, "\\\n", "")
+
+	pos, delta := p.pos, len(def)-len(name)
+	p.text = p.text[:pos] + def + p.text[pos+len(name):]
+	p.edits = append(p.edits, edit{pos, len(name), len(def)})
+	// Texts of all the active aliases contain the substituted word.
+	for i := range p.activeAliases {
+		p.activeAliases[i].end += delta
+	}
+	p.activeAliases = append(p.activeAliases, activeAlias{name, pos + len(def)})
+	for i := range p.aliasNext {
+		if p.aliasNext[i] > pos {
+			p.aliasNext[i] += delta
+		}
+	}
+	if def != "" && strings.ContainsRune(" \t", rune(def[len(def)-1])) {
+		p.addAliasNext(pos + len(def))
+	}
+	return true
+}
+
+// Makes the next word from pos subject to alias substitution.
+func (p *parser) addAliasNext(pos int) {
+	i := sort.SearchInts(p.aliasNext, pos)
+	if i < len(p.aliasNext) && p.aliasNext[i] == pos {
+		return
+	}
+	p.aliasNext = append(p.aliasNext, 0)
+	copy(p.aliasNext[i+1:], p.aliasNext[i:])
+	p.aliasNext[i] = pos
+}
+
+// Returns whether the word at the current position is subject to alias
+// substitution because of p.aliasNext, and removes the positions it covers.
+func (p *parser) takeAliasNext() bool {
+	i := sort.SearchInts(p.aliasNext, p.pos+1)
+	p.aliasNext = p.aliasNext[i:]
+	return i > 0
+}
+
+// Returns the word at the current position if it is an unquoted bareword that
+// could be the name of an alias, or "" otherwise.
+func (p *parser) aliasName(opt nodeOpt) string {
+	rest := p.rest()
+	i := strings.IndexAny(rest, barewordStopper[opt])
+	if i == -1 {
+		return rest
+	}
+	if !strings.ContainsRune(exprStopper[opt], rune(rest[i])) {
+		// The word continues with a non-bareword, like in "foo'bar'".
+		return ""
+	}
+	return rest[:i]
+}
+
+// Removes aliases whose texts have been parsed from p.activeAliases.
+func (p *parser) pruneActiveAliases() {
+	active := p.activeAliases[:0]
+	for _, a := range p.activeAliases {
+		if p.pos < a.end {
+			active = append(active, a)
+		}
+	}
+	p.activeAliases = active
+}
+
+func (p *parser) aliasActive(name string) bool {
+	for _, a := range p.activeAliases {
+		if a.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -3,12 +3,17 @@ package parse
 type Node interface {
 	Begin() int
 	End() int
+	// Line and Col return the 1-based line and column numbers of Begin(). The
+	// column is in bytes.
+	Line() int
+	Col() int
 	Parent() Node
 	Children() []Node
 	Source() string
 
 	setBegin(int)
 	setEnd(int)
+	setLineCol(int, int)
 	setSource(string)
 	setParent(Node)
 	addChild(Node)
@@ -17,21 +22,26 @@ type Node interface {
 type node struct {
 	begin    int
 	end      int
+	line     int
+	col      int
 	source   string
 	parent   Node
 	children []Node
 }
 
-func (n *node) Begin() int         { return n.begin }
-func (n *node) setBegin(i int)     { n.begin = i }
-func (n *node) End() int           { return n.end }
-func (n *node) setEnd(i int)       { n.end = i }
-func (n *node) Source() string     { return n.source }
-func (n *node) setSource(s string) { n.source = s }
-func (n *node) Parent() Node       { return n.parent }
-func (n *node) setParent(m Node)   { n.parent = m }
-func (n *node) Children() []Node   { return n.children }
-func (n *node) addChild(m Node)    { n.children = append(n.children, m) }
+func (n *node) Begin() int          { return n.begin }
+func (n *node) setBegin(i int)      { n.begin = i }
+func (n *node) End() int            { return n.end }
+func (n *node) setEnd(i int)        { n.end = i }
+func (n *node) Line() int           { return n.line }
+func (n *node) Col() int            { return n.col }
+func (n *node) setLineCol(l, c int) { n.line, n.col = l, c }
+func (n *node) Source() string      { return n.source }
+func (n *node) setSource(s string)  { n.source = s }
+func (n *node) Parent() Node        { return n.parent }
+func (n *node) setParent(m Node)    { n.parent = m }
+func (n *node) Children() []Node    { return n.children }
+func (n *node) addChild(m Node)     { n.children = append(n.children, m) }
 
 const (
 	inlineWhitespaceSet = " \t\r"
@@ -62,10 +72,13 @@ func (w *Whitespaces) parse(p *parser, opt whitespacesOpt) {
 	if !p.consumePrefix("\n") {
 		return
 	}
-	for _, pending := range p.pendingHeredocs {
+	// Clear the list before parsing the heredocs, since expansions in their
+	// bodies can contain newlines too.
+	pendingHeredocs := p.pendingHeredocs
+	p.pendingHeredocs = nil
+	for _, pending := range pendingHeredocs {
 		parse(p, pending.dest, pending)
 	}
-	p.pendingHeredocs = nil
 	consumeWhitespacesAndComment(p, whitespaceSet, semicolon)
 }
 
@@ -11,24 +11,103 @@ import (
 	"unicode/utf8"
 )
 
-func Parse(text string) (*Chunk, error) {
-	p := newParser(text)
-	n := &Chunk{}
-	parse(p, n, normal)
-	if p.rest() != "" {
-		p.errorf("unparsed code")
+// Parse parses text as a shell script. The name identifies the source of the
+// text, like a file name, and can be retrieved later with SourceOf.
+//
+// Alias substitution is not performed; use ParseWithAliases for that.
+func Parse(name, text string) (*Chunk, error) {
+	return ParseWithAliases(name, text, nil)
+}
+
+// ParseWithAliases is like Parse, but also performs alias substitution with
+// aliases looked up with the given function.
+//
+// Since the entire text is parsed at once, aliases defined in the text don't
+// affect the parsing of the text itself. To make such aliases take effect on
+// later lines like POSIX requires, use Reader instead.
+func ParseWithAliases(name, text string, aliases Aliases) (*Chunk, error) {
+	n, p := parseChunk(name, text, 1, aliases)
+	if len(p.err.Errors) == 0 {
+		return n, nil
 	}
+	return n, p.err
+}
+
+// ParseText parses text that is expanded like the body of an unquoted heredoc,
+// such as the value of $PS1. The name has the same meaning as in Parse.
+func ParseText(name, text string) (*Text, error) {
+	p := newParser(text)
+	n := &Text{name: name}
+	parseNoOpt(p, n)
 	if len(p.err.Errors) == 0 {
 		return n, nil
 	}
 	return n, p.err
 }
 
+// IsIncomplete returns whether text ends in the middle of a command, like
+// within a quoted string or an unfinished compound command, before the
+// delimiter of a heredoc, after an operator like "&&" or "|", or after a line
+// continuation. Such text is either invalid or has a different meaning on its
+// own, but may become valid when more text is appended.
+//
+// This is useful for interactive shells to decide whether to read another line
+// before executing the code.
+func IsIncomplete(text string) bool {
+	_, p := parseChunk("", text, 1, nil)
+	return p.needsMore()
+}
+
+// Parses text that starts at the given line of the source.
+func parseChunk(name, text string, line int, aliases Aliases) (*Chunk, *parser) {
+	p := newParser(text)
+	p.firstLine = line
+	p.aliases = aliases
+	n := &Chunk{name: name, line: line}
+	parse(p, n, normal)
+	if p.rest() != "" {
+		p.errorf("unparsed code")
+	}
+	return n, p
+}
+
 type Chunk struct {
 	node
+	name   string
+	line   int
 	AndOrs []*AndOr
 }
 
+// SourceOf returns the name and text of the source n was parsed from, found
+// from the root of the tree n belongs to, along with the line number the text
+// starts at; the latter is not 1 when the text is a part of a larger source
+// read with a Reader. The name is empty if the root is not a Chunk or a Text.
+func SourceOf(n Node) (name, text string, line int) {
+	for n.Parent() != nil {
+		n = n.Parent()
+	}
+	switch n := n.(type) {
+	case *Chunk:
+		return n.name, n.Source(), n.line
+	case *Text:
+		return n.name, n.Source(), 1
+	}
+	return "", n.Source(), 1
+}
+
+// Text is the root node of text parsed by ParseText.
+type Text struct {
+	node
+	name     string
+	Segments []Segment
+}
+
+func (t *Text) parse(p *parser, _ struct{}) {
+	for !p.eof() {
+		addTo(&t.Segments, Segment(parseNoOpt(p, &HeredocSegment{})))
+	}
+}
+
 type nodeOpt uint
 
 const (
@@ -64,9 +143,11 @@ type AndOr struct {
 	node
 	Pipelines []*Pipeline
 	AndOp     []bool
+	// Whether the AndOr is terminated by "&", making it an asynchronous list.
+	Async bool
 }
 
-// AndOr = Pipeline iw { ("&&" | "||") w Pipeline iw }
+// AndOr = Pipeline iw { ("&&" | "||") w Pipeline iw } [ "&" ]
 func (ao *AndOr) parse(p *parser, opt nodeOpt) {
 	addTo(&ao.Pipelines, parse(p, &Pipeline{}, opt))
 	p.inlineWhitespace()
@@ -78,9 +159,18 @@ func (ao *AndOr) parse(p *parser, opt nodeOpt) {
 		}
 		ao.AndOp = append(ao.AndOp, op == "&&")
 		p.whitespace()
+		if p.eof() || !p.mayParseCommand(opt) {
+			p.errorf("missing pipeline after %s", op)
+		}
 		addTo(&ao.Pipelines, parse(p, &Pipeline{}, opt))
 		p.inlineWhitespace()
 	}
+	// A "&&" would have been consumed by the loop above, so a "&" here always
+	// terminates the AndOr.
+	if p.maybeMeta("&") {
+		ao.Async = true
+		p.inlineWhitespace()
+	}
 }
 
 type Pipeline struct {
@@ -98,6 +188,9 @@ func (pl *Pipeline) parse(p *parser, opt nodeOpt) {
 		// | should be meta
 		p.consumePrefix("|")
 		p.whitespace()
+		if p.eof() || !p.mayParseCommand(opt) {
+			p.errorf("missing command after |")
+		}
 		addTo(&pl.Commands, parse(p, &Command{}, opt))
 		p.inlineWhitespace()
 	}
@@ -132,12 +225,17 @@ type SubshellGroup struct {
 
 var (
 	assignPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*=`)
+	namePattern   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*$`)
 	redirPattern  = regexp.MustCompile(`^[0-9]*[<>]`)
 )
 
 func (fm *Command) parse(p *parser, opt nodeOpt) {
+	p.aliasNext = nil
 	p.whitespace()
-	// Parse assignments, possibly mixed with redirections.
+	// Parse assignments, possibly mixed with redirections. What follows is the
+	// command word, which is subject to alias substitution; since the text of
+	// the alias can start with more assignments and redirections, continue
+	// parsing them after a substitution.
 	for {
 		if assignPattern.MatchString(p.rest()) {
 			addTo(&fm.Assigns, parse(p, &Assign{}, opt))
@@ -145,37 +243,64 @@ func (fm *Command) parse(p *parser, opt nodeOpt) {
 		} else if redirPattern.MatchString(p.rest()) {
 			addTo(&fm.Redirs, parse(p, &Redir{}, opt))
 			p.inlineWhitespace()
+		} else if p.substituteAlias(opt) {
+			p.inlineWhitespace()
 		} else {
 			break
 		}
 	}
 	switch {
 	case p.maybeMeta("{"):
+		p.pushCloser("}")
 		fm.Data = Group{parse(p, &Chunk{}, normal)}
 		p.meta("}")
+		p.popCloser()
 		p.inlineWhitespace()
 	case p.maybeMeta("("):
+		p.pushCloser(")")
 		fm.Data = SubshellGroup{parse(p, &Chunk{}, normal)}
 		p.meta(")")
+		p.popCloser()
 		p.inlineWhitespace()
 	case p.maybeWord("for", opt):
 		p.inlineWhitespace()
+		p.pushCloser("done")
 		fm.Data = parseFor(p, opt)
+		p.popCloser()
 	case p.maybeWord("case", opt):
 		p.inlineWhitespace()
+		p.pushCloser("esac")
 		fm.Data = parseCase(p, opt)
+		p.popCloser()
 	case p.maybeWord("if", opt):
 		p.inlineWhitespace()
+		p.pushCloser("fi")
 		fm.Data = parseIf(p, opt)
+		p.popCloser()
 	case p.maybeWord("while", opt):
 		p.inlineWhitespace()
+		p.pushCloser("done")
 		fm.Data = parseWhile(p, opt)
+		p.popCloser()
 	case p.maybeWord("until", opt):
 		p.inlineWhitespace()
+		p.pushCloser("done")
 		fm.Data = parseUntil(p, opt)
+		p.popCloser()
 	default:
 		var words []*Compound
 		for {
+			if p.takeAliasNext() {
+				// The word follows the text of an alias that ends in a blank.
+				pos := p.pos
+				if p.substituteAlias(opt) {
+					// The first word of the text is also subject to alias
+					// substitution.
+					p.addAliasNext(pos)
+					p.inlineWhitespace()
+					continue
+				}
+			}
 			if redirPattern.MatchString(p.rest()) {
 				addTo(&fm.Redirs, parse(p, &Redir{}, opt))
 			} else if p.mayParseExpr(opt) {
@@ -218,7 +343,14 @@ type For struct {
 
 func parseFor(p *parser, opt nodeOpt) For {
 	var data For
+	begin := p.pos
 	data.VarName = parse(p, &Compound{}, opt)
+	if name := p.source(data.VarName); name != "" && !namePattern.MatchString(name) {
+		end := p.pos
+		p.pos = begin
+		p.errorf("invalid variable name %q", name)
+		p.pos = end
+	}
 	p.inlineWhitespace()
 	if p.maybeWord("in", opt) {
 		data.Values = []*Compound{}
@@ -276,6 +408,8 @@ func parseCase(p *parser, opt nodeOpt) Case {
 			if p.maybeWord("esac", opt) {
 				p.whitespaceOrSemicolon()
 				seenEsac = true
+			} else if p.unexpectedClosingWord(opt) {
+				break
 			}
 			addTo(&body, parse(p, &AndOr{}, opt))
 			p.whitespace()
@@ -329,6 +463,9 @@ branches:
 				p.whitespaceOrSemicolon()
 				addTo(&data.Bodies, body)
 				continue branches
+			} else if p.unexpectedClosingWord(opt) {
+				addTo(&data.Bodies, body)
+				return data
 			}
 			addTo(&body, parse(p, &AndOr{}, opt))
 			p.whitespaceOrSemicolon()
@@ -372,6 +509,8 @@ func parseAndOrsTerminatedBy(p *parser, opt nodeOpt, word string) []*AndOr {
 		if p.maybeWord(word, opt) {
 			p.whitespaceOrSemicolon()
 			return body
+		} else if p.unexpectedClosingWord(opt) {
+			return body
 		}
 		addTo(&body, parse(p, &AndOr{}, opt))
 		p.whitespaceOrSemicolon()
@@ -380,6 +519,30 @@ func parseAndOrsTerminatedBy(p *parser, opt nodeOpt, word string) []*AndOr {
 	return body
 }
 
+// Reserved words that close a part of a compound command.
+var closingWords = []string{"then", "do", "done", "elif", "else", "fi", "esac"}
+
+// Reports an error and returns true if the text at the current position is a
+// closing reserved word other than the one that is expected, which is checked
+// by the caller beforehand. The error is reported at the word instead of at
+// the end of the text, so that text like "if true; done" is not considered
+// incomplete. The error is not repeated when the same word is checked again
+// after the caller has returned, like in "if true; done".
+func (p *parser) unexpectedClosingWord(opt nodeOpt) bool {
+	for _, word := range closingWords {
+		begin := p.pos
+		if p.maybeWord(word, opt) {
+			p.pos = begin
+			errors := p.err.Errors
+			if len(errors) == 0 || errors[len(errors)-1].Position != p.recoverPos(begin) {
+				p.errorf("unexpected keyword %q", word)
+			}
+			return true
+		}
+	}
+	return false
+}
+
 type Assign struct {
 	node
 	LHS string
@@ -417,9 +580,13 @@ func (hd *Heredoc) parse(p *parser, ph *pendingHeredoc) {
 		tabPrefix = `\t*`
 	}
 	endRegexp := regexp.MustCompile(`(?m)^` + tabPrefix + regexp.QuoteMeta(ph.delim) + `$\n?`)
+	p.pushCloser(ph.delim)
+	defer p.popCloser()
 	endLoc := endRegexp.FindStringIndex(p.rest())
 	if endLoc == nil {
-		p.errorf("undelimited heredoc %q", ph.delim)
+		// The heredoc extends to the end of the text, so more text could
+		// contain the delimiter.
+		p.errorfMaybeEOF(true, "undelimited heredoc %q", ph.delim)
 	}
 
 	if ph.quoted {
@@ -434,18 +601,26 @@ func (hd *Heredoc) parse(p *parser, ph *pendingHeredoc) {
 			hd.Text = leadingTabs.ReplaceAllLiteralString(hd.Text, "")
 		}
 	} else {
-		// TODO: Support stripLeadingTabs
 		begin := p.pos
-		savedText := p.text
+		// Edits to the text in the body, and aliases substituted within, don't
+		// outlive the body.
+		savedText, savedEdits := p.text, len(p.edits)
+		savedActiveAliases := append([]activeAlias(nil), p.activeAliases...)
 		if endLoc != nil {
 			// Hack: clip the text when parsing segments so that parsing of
 			// expansion segments doesn't consume the heredoc delimiter.
 			p.text = p.text[:p.pos+endLoc[0]]
 		}
+		if ph.stripLeadingTabs {
+			// Tabs are stripped from the lines of the body before parsing it,
+			// so that they are stripped inside expansions too.
+			p.stripLeadingTabs()
+		}
 		for !p.eof() {
-			addTo(&hd.Segments, Segment(parse(p, &HeredocSegment{}, ph.stripLeadingTabs)))
+			addTo(&hd.Segments, Segment(parseNoOpt(p, &HeredocSegment{})))
 		}
-		p.text = savedText
+		p.text, p.edits = savedText, p.edits[:savedEdits]
+		p.activeAliases = savedActiveAliases
 		if endLoc == nil {
 			p.pos = len(p.text)
 		} else {
@@ -462,23 +637,11 @@ type HeredocSegment struct {
 
 func (seg *HeredocSegment) Segment() (*Primary, string) { return seg.Expansion, seg.Text }
 
-var newlineAndTabs = regexp.MustCompile(`\n\t+`)
-
-func (seg *HeredocSegment) parse(p *parser, stripLeadingTabs bool) {
+func (seg *HeredocSegment) parse(p *parser, _ struct{}) {
 	if p.hasPrefixIn("$", "`") != "" {
-		// TODO: Strip leading tabs when parsing expansions too. Leading tabs
-		// are meaningful when inside string literals or just after a line
-		// continuation.
 		seg.Expansion = parse(p, &Primary{}, normal)
 	} else {
-		sol := p.pos == 0 || p.text[p.pos-1] == '\n'
 		seg.Text = parseStringSegment(p, "$`")
-		if stripLeadingTabs {
-			seg.Text = newlineAndTabs.ReplaceAllLiteralString(seg.Text, "\n")
-			if sol {
-				seg.Text = strings.TrimLeft(seg.Text, "\t")
-			}
-		}
 	}
 }
 
@@ -552,26 +715,36 @@ func (rd *Redir) parse(p *parser, opt nodeOpt) {
 	}
 	rd.Right = parse(p, &Compound{}, opt)
 	if rd.Mode == RedirHeredoc {
-		delim, quoted := parseHeredocDelim(p, rd.Right)
+		delim, quoted := parseHeredocDelim(rd.Right)
 		rd.Heredoc = &Heredoc{}
 		pending := &pendingHeredoc{delim, quoted, stripLeadingTabs, rd.Heredoc}
 		p.pendingHeredocs = append(p.pendingHeredocs, pending)
 	}
 }
 
-func parseHeredocDelim(p *parser, cp *Compound) (delim string, quoted bool) {
+// Performs quote removal on the heredoc delimiter, and returns whether any part
+// of it is quoted. Expansions are not performed, so they are kept as is.
+func parseHeredocDelim(cp *Compound) (delim string, quoted bool) {
 	var buf bytes.Buffer
+	buf.WriteString(cp.TildePrefix)
 	for _, pr := range cp.Parts {
 		switch pr.Type {
-		case SingleQuotedPrimary:
+		case BarewordPrimary:
+			buf.WriteString(pr.Value)
+		case EscapedPrimary, SingleQuotedPrimary:
 			quoted = true
 			buf.WriteString(pr.Value)
 		case DoubleQuotedPrimary:
-			// TODO: Unquote properly
 			quoted = true
-			buf.WriteString(p.text[pr.Begin()+1 : pr.End()-1])
+			for _, seg := range pr.Segments {
+				if expansion, text := seg.Segment(); expansion != nil {
+					buf.WriteString(expansion.Source())
+				} else {
+					buf.WriteString(text)
+				}
+			}
 		default:
-			buf.WriteString(p.text[pr.Begin():pr.End()])
+			buf.WriteString(pr.Source())
 		}
 	}
 	return buf.String(), quoted
@@ -585,8 +758,14 @@ type Compound struct {
 }
 
 func (cp *Compound) parse(p *parser, opt nodeOpt) {
-	// TODO: Parse TildePrefix correctly in assignment RHS
-	if prefix := findTildePrefix(p.rest(), opt); prefix != "" {
+	// In the RHS of an assignment, a tilde prefix is also terminated by ":".
+	// Tilde prefixes after each unquoted ":" are left in the bareword, and
+	// are expanded by the evaluator.
+	inAssign := false
+	if len(p.stack) >= 2 {
+		_, inAssign = p.stack[len(p.stack)-2].(*Assign)
+	}
+	if prefix := findTildePrefix(p.rest(), opt, inAssign); prefix != "" {
 		p.consume(len(prefix))
 		cp.TildePrefix = prefix
 	}
@@ -608,13 +787,11 @@ const (
 	inBackquotesExprStopper = normalExprStopper + "`"
 
 	// A modifier argument (the "foo" in "${a:-foo}") is terminated by "}". The
-	// usual expression stoppers are parsed as barewords characters; for
-	// example, in "${a:-&|  foo}", the entire "&|  foo" part can be parsed as
-	// one bareword. This is not specified by POSIX, but supported by all of
-	// dash, bash and ksh.
-	//
-	// TODO: Also admit spaces and tabs.
-	modifierArgExprStopper = " \t}"
+	// usual expression stoppers, including whitespaces, are parsed as bareword
+	// characters; for example, in "${a:-&|  foo}", the entire "&|  foo" part
+	// can be parsed as one bareword. This is not specified by POSIX, but
+	// supported by all of dash, bash and ksh.
+	modifierArgExprStopper = "}"
 )
 
 var exprStopper = [...]string{
@@ -627,7 +804,7 @@ func (p *parser) mayParseExpr(opt nodeOpt) bool {
 	return p.nextInCompl(exprStopper[opt])
 }
 
-func findTildePrefix(s string, opt nodeOpt) string {
+func findTildePrefix(s string, opt nodeOpt, inAssign bool) string {
 	if !hasPrefix(s, "~") {
 		return ""
 	}
@@ -636,7 +813,9 @@ func findTildePrefix(s string, opt nodeOpt) string {
 			// Skip the initial ~
 			continue
 		}
-		if r == '/' || runeIn(r, exprStopper[opt]) {
+		// Whitespaces are checked separately, since they are not expression
+		// stoppers in modifier arguments.
+		if r == '/' || (inAssign && r == ':') || runeIn(r, exprStopper[opt]) || runeIn(r, whitespaceSet) {
 			return s[:i]
 		} else if runeIn(r, barewordStopper[opt]) {
 			return ""
@@ -710,6 +889,8 @@ func (pr *Primary) parse(p *parser, opt nodeOpt) {
 		}
 	case p.consumePrefix("'"):
 		pr.Type = SingleQuotedPrimary
+		p.pushCloser("'")
+		defer p.popCloser()
 		begin := p.pos
 		_ = p.consumeWhileNotIn("'")
 		end := p.pos
@@ -717,12 +898,20 @@ func (pr *Primary) parse(p *parser, opt nodeOpt) {
 		// single-quoted string has leading line continuations, those will be
 		// skipped. Hence, we adjust begin to the position of the opening quote,
 		// and adjust it back after recovery.
-		pr.Value = p.orig[p.recoverPos(begin-1)+1 : p.recoverPos(end)]
+		if p.unedited(begin, end) {
+			pr.Value = p.orig[p.recoverPos(begin-1)+1 : p.recoverPos(end)]
+		} else {
+			// The string is in the text of an alias, or in the body of a <<-
+			// heredoc with leading tabs stripped; use the edited text.
+			pr.Value = p.text[begin:end]
+		}
 		if !p.consumePrefix("'") {
 			p.errorf("unterminated single-quoted string")
 		}
 	case p.consumePrefix(`"`):
 		pr.Type = DoubleQuotedPrimary
+		p.pushCloser(`"`)
+		defer p.popCloser()
 		for !p.eof() && !p.hasPrefix(`"`) {
 			addTo(&pr.Segments, Segment(parseNoOpt(p, &DQSegment{})))
 		}
@@ -746,6 +935,8 @@ func (pr *Primary) parse(p *parser, opt nodeOpt) {
 		// "))" as the terminator when there are no unmatched left parentheses.
 		// We follow their behavior here, and stop parsing as soon as we see a
 		// ")" with no matching "(".
+		p.pushCloser("))")
+		defer p.popCloser()
 		unmatchedLeftParens := 0
 		for !p.eof() {
 			if unmatchedLeftParens == 0 {
@@ -760,12 +951,16 @@ func (pr *Primary) parse(p *parser, opt nodeOpt) {
 		p.errorf("unterminated arithmetic expression")
 	case p.consumePrefix("`"):
 		pr.Type = OutputCapturePrimary
+		p.pushCloser("`")
+		defer p.popCloser()
 		pr.Body = parse(p, &Chunk{}, inBackquotes)
 		if !p.consumePrefix("`") {
 			p.errorf("missing closing backquote for output capture")
 		}
 	case p.consumePrefix("$("):
 		pr.Type = OutputCapturePrimary
+		p.pushCloser(")")
+		defer p.popCloser()
 		pr.Body = parse(p, &Chunk{}, normal)
 		if !p.consumePrefix(")") {
 			p.errorf("missing closing parenthesis for output capture")
@@ -901,6 +1096,8 @@ func (va *Variable) parse(p *parser, opt nodeOpt) {
 		return
 	}
 	// Variable with braces, e.g. ${x:-fallback}
+	p.pushCloser("}")
+	defer p.popCloser()
 	if p.consumePrefix("#") {
 		// We have seen "${#". It can either be the variable $# or the string
 		// length operator, depending on what comes next.
@@ -1013,9 +1210,6 @@ func (md *Modifier) parse(p *parser, opt nodeOpt) {
 		p.errorf("missing or invalid variable modifier, assuming ':-'")
 		md.Operator = ":-"
 	}
-	// TODO: Most other shells (dash, bash and ksh) allow the modifier argument
-	// to contain multiple words, even though it's not specified in POSIX.
-	// Support that too.
 	md.Argument = parse(p, &Compound{}, modifierArg)
 }
 
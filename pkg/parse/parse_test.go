@@ -0,0 +1,62 @@
+package parse
+
+import "testing"
+
+var isIncompleteTests = []struct {
+	name string
+	text string
+	want bool
+}{
+	{"complete command", "echo foo\n", false},
+	{"empty text", "", false},
+	{"line continuation", "echo foo \\\n", true},
+
+	{"unterminated single quote", "echo 'foo\n", true},
+	{"unterminated double quote", "echo \"foo\n", true},
+	{"unterminated command substitution", "echo $(echo\n", true},
+	{"unterminated arithmetic expansion", "echo $((1 +\n", true},
+
+	{"open for", "for x in a b\n", true},
+	{"open for body", "for x in a b; do\necho $x\n", true},
+	{"open if", "if true\n", true},
+	{"open if body", "if true; then\n", true},
+	{"open else", "if true; then :; else\n", true},
+	{"open while", "while true; do\n", true},
+	{"open case", "case x in\n", true},
+	{"open case pattern", "case x in x) echo;;\n", true},
+	{"open brace group", "{ echo\n", true},
+	{"open subshell", "( echo\n", true},
+	{"open function body", "f() {\n", true},
+
+	{"pending heredoc", "cat <<EOF\nfoo\n", true},
+	{"pending quoted heredoc", "cat <<'EOF'\n", true},
+	{"second pending heredoc", "cat <<A <<B\nA\n", true},
+	{"terminated heredoc", "cat <<EOF\nfoo\nEOF\n", false},
+
+	{"trailing &&", "echo a &&\n", true},
+	{"trailing ||", "echo a ||\n", true},
+	{"trailing |", "echo a |\n", true},
+	{"trailing && inside if", "if true &&\n", true},
+
+	{"&& followed by ||", "echo a && ||\n", false},
+	{"| followed by &&", "echo a | &&\n", false},
+	{"| followed by |", "echo a | |\n", false},
+	{"&& followed by )", "echo a && )\n", false},
+	{"invalid for variable", "for 1 in\n", false},
+	{"done in if", "if true; done\n", false},
+	{"fi in while", "while true; fi\n", false},
+	{"esac in for body", "for x; do esac\n", false},
+	{"unmatched )", "echo )\n", false},
+	{"mismatched closer", "{ echo; )\n", false},
+	{"invalid token before open if", "echo a && ||; if true\n", false},
+}
+
+func TestIsIncomplete(t *testing.T) {
+	for _, test := range isIncompleteTests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsIncomplete(test.text); got != test.want {
+				t.Errorf("IsIncomplete(%q) = %v, want %v", test.text, got, test.want)
+			}
+		})
+	}
+}
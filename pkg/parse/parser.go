@@ -19,13 +19,41 @@ type parser struct {
 	// single-quoted strings ( which is the only place where \<newline> does not
 	// function as line continuation).
 	lineCont []int
+	// Whether orig ends with a line continuation.
+	endsWithLineCont bool
+	// Edits made to text during parsing, in the order they are made. Like
+	// lineCont, this is used when recovering the real position.
+	edits []edit
+	// Positions of all newlines in orig, used to find line numbers.
+	newlines []int
+	// Line number of the start of orig, when it is part of a larger source.
+	firstLine int
 
 	pos   int
 	stack []Node
 	err   Error
+	// Whether the first error was caused by reaching the end of the text, in
+	// which case the text may be the prefix of some valid code.
+	incomplete bool
+	// Tokens that close the constructs being parsed, like "fi" for an if
+	// command, innermost last.
+	closers []string
+	// If incomplete is true, a copy of closers when the first error is found.
+	// More text must contain all of them for the code to become complete.
+	unclosed []string
 	// Heredocs are collected into this list when parsing the leader (e.g.
 	// <<EOF), and resolved when parsing newlines.
 	pendingHeredocs []*pendingHeredoc
+
+	// Used for alias substitution; nil if alias substitution is disabled.
+	aliases Aliases
+	// Aliases whose text is being parsed. See (*parser).substituteAlias.
+	activeAliases []activeAlias
+	// Positions in ascending order, from each of which the next word is also
+	// subject to alias substitution. These are the positions after the texts
+	// of substituted aliases that end in a blank, and the start of the text of
+	// an alias substituted for such a word.
+	aliasNext []int
 }
 
 type pendingHeredoc struct {
@@ -35,12 +63,33 @@ type pendingHeredoc struct {
 	dest             *Heredoc
 }
 
+// An edit to text, replacing oldLen bytes at pos with newLen bytes. This is
+// used for stripping leading tabs in the body of <<- heredocs (where newLen is
+// 0) and alias substitution.
+type edit struct {
+	pos, oldLen, newLen int
+}
+
+// Returns the position before the edit.
+func (e edit) recover(pos int) int {
+	if pos >= e.pos+e.newLen {
+		return pos - e.newLen + e.oldLen
+	} else if pos > e.pos {
+		// Inside the new text; use the start of the old text.
+		return e.pos
+	}
+	return pos
+}
+
 func newParser(orig string) *parser {
-	var lineCont []int
+	var lineCont, newlines []int
 	buf := &bytes.Buffer{}
 
 	lastBackslash := false
-	for _, r := range orig {
+	for i, r := range orig {
+		if r == '\n' {
+			newlines = append(newlines, i)
+		}
 		if lastBackslash {
 			if r == '\n' {
 				lineCont = append(lineCont, buf.Len())
@@ -59,18 +108,77 @@ func newParser(orig string) *parser {
 	if lastBackslash {
 		lineCont = append(lineCont, buf.Len())
 	}
-	return &parser{orig: orig, text: buf.String(), lineCont: lineCont}
+	endsWithLineCont := len(lineCont) > 0 && lineCont[len(lineCont)-1] == buf.Len()
+	return &parser{orig: orig, text: buf.String(), lineCont: lineCont,
+		endsWithLineCont: endsWithLineCont, newlines: newlines, firstLine: 1}
 }
 
 func (p *parser) recoverPos(pos int) int {
+	// Find the position before all the edits first, since lineCont contains
+	// indices into the unedited text.
+	for i := len(p.edits) - 1; i >= 0; i-- {
+		pos = p.edits[i].recover(pos)
+	}
 	// sort.SearchInts(a, i+1) returns the number of elements in a that <= i.
 	// Here, we find the number of line continuations that occur before pos
-	// (inclusive). Each line continuation occupies two bytes.
-	return pos + 2*sort.SearchInts(p.lineCont, pos+1)
+	// (inclusive). Each line continuation occupies two bytes, except for a
+	// backslash just before EOF, which occupies one.
+	pos += 2 * sort.SearchInts(p.lineCont, pos+1)
+	if pos > len(p.orig) {
+		pos = len(p.orig)
+	}
+	return pos
 }
 
-func lineCol(s string, pos int) (int, int) {
-	return 1 + strings.Count(s[:pos], "\n"), 1 + pos - strings.LastIndex(s[:pos], "\n")
+// Returns whether text between begin and end is the same as the corresponding
+// text in orig, except for line continuations; this is not the case when the
+// text is affected by any edit.
+func (p *parser) unedited(begin, end int) bool {
+	for i := len(p.edits) - 1; i >= 0; i-- {
+		e := p.edits[i]
+		if e.pos < end && (e.pos > begin || e.pos+e.newLen > begin) {
+			return false
+		}
+		begin, end = e.recover(begin), e.recover(end)
+	}
+	return true
+}
+
+// Strips leading tabs from all lines in the rest of text, which is the body of
+// a <<- heredoc. Like dash and bash, lines are joined with line continuations
+// first, so tabs after a line continuation are kept.
+func (p *parser) stripLeadingTabs() {
+	var buf strings.Builder
+	buf.WriteString(p.text[:p.pos])
+	for i := p.pos; i < len(p.text); {
+		sol := i == p.pos || p.text[i-1] == '\n'
+		if sol && p.text[i] == '\t' {
+			n := len(p.text[i:]) - len(strings.TrimLeft(p.text[i:], "\t"))
+			p.edits = append(p.edits, edit{buf.Len(), n, 0})
+			i += n
+		} else {
+			buf.WriteByte(p.text[i])
+			i++
+		}
+	}
+	p.text = buf.String()
+}
+
+// Returns whether the text needs more text to become complete. Must be called
+// after parsing.
+func (p *parser) needsMore() bool {
+	return p.endsWithLineCont || (len(p.err.Errors) > 0 && p.incomplete)
+}
+
+// Returns the 1-based line and column numbers of pos, a position in orig. The
+// column is in bytes.
+func (p *parser) lineCol(pos int) (int, int) {
+	// The number of newlines before pos.
+	i := sort.SearchInts(p.newlines, pos)
+	if i == 0 {
+		return p.firstLine, pos + 1
+	}
+	return p.firstLine + i, pos - p.newlines[i-1]
 }
 
 func (p *parser) rest() string {
@@ -86,12 +194,34 @@ func (p *parser) source(n Node) string {
 }
 
 func (p *parser) errorf(format string, a ...interface{}) {
+	p.errorfMaybeEOF(p.eof(), format, a...)
+}
+
+// Like errorf, but also takes whether the error is caused by reaching the end
+// of the text, for errors that are not reported at the end of the text.
+func (p *parser) errorfMaybeEOF(eof bool, format string, a ...interface{}) {
+	if len(p.err.Errors) == 0 {
+		p.incomplete = eof
+		if eof {
+			p.unclosed = append([]string(nil), p.closers...)
+		}
+	}
 	pos := p.recoverPos(p.pos)
-	line, col := lineCol(p.orig, pos)
+	line, col := p.lineCol(pos)
 	p.err.Errors = append(p.err.Errors,
 		ErrorEntry{pos, line, col, fmt.Sprintf(format, a...)})
 }
 
+// Records that the construct being parsed is closed by closer. Must be paired
+// with popCloser.
+func (p *parser) pushCloser(closer string) {
+	p.closers = append(p.closers, closer)
+}
+
+func (p *parser) popCloser() {
+	p.closers = p.closers[:len(p.closers)-1]
+}
+
 func (p *parser) consume(i int) string {
 	consumed := p.rest()[:i]
 	p.pos += i
@@ -163,6 +293,7 @@ type parseNode[O any] interface {
 
 func parse[O any, N parseNode[O]](p *parser, n N, opt O) N {
 	n.setBegin(p.recoverPos(p.pos))
+	n.setLineCol(p.lineCol(n.Begin()))
 	p.stack = append(p.stack, n)
 
 	n.parse(p, opt)
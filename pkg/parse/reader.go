@@ -0,0 +1,199 @@
+package parse
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Reader parses code read from an io.Reader incrementally.
+//
+// POSIX requires the shell to read and execute one complete command at a time,
+// so that the code can be generated on the fly, and commands can read from the
+// same input as the shell. To make the latter work, Reader never reads past the
+// newline that ends a complete command. For this reason, it reads one byte at a
+// time from the underlying reader, unless the latter implements io.ByteReader,
+// in which case it is assumed to be fine to buffer.
+type Reader struct {
+	name string
+	r    io.ByteReader
+	// Line number of the next line.
+	line    int
+	eof     bool
+	aliases Aliases
+}
+
+// NewReader creates a new Reader. The name has the same meaning as in Parse.
+//
+// If aliases is not nil, it is used to look up aliases for alias substitution.
+// Since each Chunk is parsed when Next is called, aliases defined when
+// evaluating a Chunk take effect in the next Chunk, as required by POSIX.
+func NewReader(name string, r io.Reader, aliases Aliases) *Reader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+	return &Reader{name, br, 1, false, aliases}
+}
+
+// Next reads lines until they form one or more complete commands, and returns
+// them as a Chunk. It returns io.EOF when the input is exhausted.
+//
+// If the code contains a syntax error, the Chunk is returned along with an
+// error of type Error; the code of the Chunk ends at the line where the error
+// is found.
+func (r *Reader) Next() (*Chunk, error) {
+	for {
+		_, n, err := r.read()
+		if err != nil || len(n.AndOrs) > 0 {
+			return n, err
+		}
+		// Only whitespaces and comments.
+	}
+}
+
+// NextCode is like Next, but returns the text of the code instead, which may
+// also consist of only whitespaces and comments. Syntax errors are ignored.
+func (r *Reader) NextCode() (string, error) {
+	text, _, err := r.read()
+	if _, ok := err.(Error); ok {
+		return text, nil
+	}
+	return text, err
+}
+
+// Reads lines until they form complete code, and returns the text along with
+// the result of parsing it.
+func (r *Reader) read() (string, *Chunk, error) {
+	var sb strings.Builder
+	// Tokens that close the constructs left unclosed when the text was last
+	// parsed, and have not appeared in the lines read since.
+	var unclosed []string
+	for {
+		if r.eof {
+			return "", nil, io.EOF
+		}
+		lineStart := sb.Len()
+		err := r.readLine(&sb)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return "", nil, err
+		}
+		text := sb.String()
+		if r.eof && text == "" {
+			return "", nil, io.EOF
+		}
+		unclosed = r.removeClosers(unclosed, text[lineStart:])
+		if !r.eof && len(unclosed) > 0 {
+			// The code is still incomplete; see removeClosers.
+			continue
+		}
+		n, p := parseChunk(r.name, text, r.line, r.aliases)
+		if !r.eof && p.needsMore() {
+			if !p.endsWithLineCont {
+				unclosed = p.unclosed
+			}
+			continue
+		}
+		r.line += strings.Count(text, "\n")
+		if len(p.err.Errors) > 0 {
+			return text, n, p.err
+		}
+		return text, n, nil
+	}
+}
+
+// Matches simple braced parameter expansions like ${foo}, whose "}" can't
+// close a brace group. The expansion must not follow \ or $, which could make
+// the $ literal.
+var simpleBracedVariable = regexp.MustCompile(`(^|[^\\$])\$\{#?[a-zA-Z0-9_]*\}`)
+
+// Removes the closers that may appear in a line from unclosed, and returns the
+// rest.
+//
+// Incomplete code can only become complete after all the constructs left
+// unclosed are closed, so there is no need to parse it again before that.
+// Otherwise, reading a long command would be quadratic, since the code would
+// be parsed for every line.
+//
+// This only needs to be conservative: when in doubt, it returns nil, and the
+// code is simply parsed again.
+func (r *Reader) removeClosers(unclosed []string, line string) []string {
+	if len(unclosed) == 0 || strings.HasSuffix(line, "\\\n") {
+		// A line continuation joins the line with the next one.
+		return nil
+	}
+	if r.aliases != nil {
+		// Texts of aliases can contain any token.
+		for _, word := range strings.FieldsFunc(line, isBarewordStopper) {
+			if _, ok := r.aliases(word); ok {
+				return nil
+			}
+		}
+	}
+	var rest []string
+	for _, closer := range unclosed {
+		if !containsCloser(line, closer) {
+			rest = append(rest, closer)
+		}
+	}
+	return rest
+}
+
+func isBarewordStopper(r rune) bool {
+	return runeIn(r, normalBarewordStopper) || runeIn(r, whitespaceSet)
+}
+
+// Returns whether text may contain closer as a token.
+func containsCloser(text, closer string) bool {
+	switch {
+	case closer == "}":
+		text = simpleBracedVariable.ReplaceAllString(text, "$1")
+	case closer != "" && strings.Trim(closer, nameSet) == "":
+		// A keyword or a heredoc delimiter made up of name characters can't be
+		// part of a longer word.
+		for i := 0; i < len(text); {
+			j := strings.Index(text[i:], closer)
+			if j == -1 {
+				return false
+			}
+			begin, end := i+j, i+j+len(closer)
+			if (begin == 0 || !runeIn(rune(text[begin-1]), nameSet)) &&
+				(end == len(text) || !runeIn(rune(text[end]), nameSet)) {
+				return true
+			}
+			i = begin + 1
+		}
+		return false
+	}
+	return strings.Contains(text, closer)
+}
+
+// Reads a line, including the terminating newline if any, into sb.
+func (r *Reader) readLine(sb *strings.Builder) error {
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		sb.WriteByte(b)
+		if b == '\n' {
+			return nil
+		}
+	}
+}
+
+type byteReader struct{ r io.Reader }
+
+func (br byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	for {
+		n, err := br.r.Read(buf[:])
+		if n == 1 {
+			return buf[0], nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package parse
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// Implements only io.Reader, so that Reader has to read one byte at a time.
+type onlyReader struct{ r io.Reader }
+
+func (r onlyReader) Read(p []byte) (int, error) { return r.r.Read(p) }
+
+var readerNextCodeTests = []struct {
+	name string
+	text string
+	want []string
+}{
+	{
+		name: "one command per line",
+		text: "echo a\necho b\n",
+		want: []string{"echo a\n", "echo b\n"},
+	},
+	{
+		name: "no trailing newline",
+		text: "echo a\necho b",
+		want: []string{"echo a\n", "echo b"},
+	},
+	{
+		name: "whitespaces and comments",
+		text: "\n# comment\necho a\n",
+		want: []string{"\n", "# comment\n", "echo a\n"},
+	},
+	{
+		name: "compound command spanning lines",
+		text: "if true\nthen\n  echo a\nfi\necho b\n",
+		want: []string{"if true\nthen\n  echo a\nfi\n", "echo b\n"},
+	},
+	{
+		name: "line continuation",
+		text: "echo a \\\nb\necho c\n",
+		want: []string{"echo a \\\nb\n", "echo c\n"},
+	},
+	{
+		name: "quoted string spanning lines",
+		text: "echo 'a\nb'\necho c\n",
+		want: []string{"echo 'a\nb'\n", "echo c\n"},
+	},
+	{
+		name: "heredoc",
+		text: "cat <<EOF\na\nEOF\necho b\n",
+		want: []string{"cat <<EOF\na\nEOF\n", "echo b\n"},
+	},
+	{
+		name: "closer in a longer word",
+		text: "for x in a; do\necho done_x\ndone\necho b\n",
+		want: []string{"for x in a; do\necho done_x\ndone\n", "echo b\n"},
+	},
+	{
+		name: "closer in a braced variable",
+		text: "{\necho ${x}\n}\necho b\n",
+		want: []string{"{\necho ${x}\n}\n", "echo b\n"},
+	},
+	{
+		name: "closer in a quoted string",
+		text: "{\necho '}'\n}\necho b\n",
+		want: []string{"{\necho '}'\n}\n", "echo b\n"},
+	},
+	{
+		name: "nested constructs",
+		text: "if true; then\nwhile false; do\n:\ndone\nfi\necho b\n",
+		want: []string{"if true; then\nwhile false; do\n:\ndone\nfi\n", "echo b\n"},
+	},
+	{
+		name: "syntax error",
+		text: "echo )\necho a\n",
+		want: []string{"echo )\n", "echo a\n"},
+	},
+	{
+		name: "incomplete at end of input",
+		text: "if true\n",
+		want: []string{"if true\n"},
+	},
+}
+
+func TestReader_NextCode(t *testing.T) {
+	for _, test := range readerNextCodeTests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, buffered := range []bool{false, true} {
+				var src io.Reader = strings.NewReader(test.text)
+				if !buffered {
+					src = onlyReader{src}
+				}
+				r := NewReader("[test]", src, nil)
+				var got []string
+				for {
+					code, err := r.NextCode()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatalf("NextCode returned error: %v", err)
+					}
+					got = append(got, code)
+				}
+				if diff := cmp.Diff(test.want, got); diff != "" {
+					t.Errorf("buffered = %v: codes (-want +got):\n%s", buffered, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestReader_DoesNotReadPastChunk(t *testing.T) {
+	src := strings.NewReader("if true\nthen :\nfi\nrest of input\n")
+	r := NewReader("[test]", onlyReader{src}, nil)
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("Next returned error: %v", err)
+	}
+	rest, _ := io.ReadAll(src)
+	if string(rest) != "rest of input\n" {
+		t.Errorf("got rest %q, want %q", rest, "rest of input\n")
+	}
+}
+
+func TestReader_Next(t *testing.T) {
+	r := NewReader("[test]", strings.NewReader(
+		"\n# comment\necho a\nif true\nthen :\nfi\n\necho b; echo c\n"), nil)
+	var got []int
+	for {
+		n, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next returned error: %v", err)
+		}
+		if n.name != "[test]" {
+			t.Errorf("got name %q, want %q", n.name, "[test]")
+		}
+		got = append(got, n.line, len(n.AndOrs))
+	}
+	// Chunks with only whitespaces and comments are skipped, but still count
+	// towards line numbers.
+	want := []int{3, 1, 4, 1, 8, 2}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("lines and numbers of commands (-want +got):\n%s", diff)
+	}
+}
+
+func TestReader_Next_ErrorPosition(t *testing.T) {
+	r := NewReader("[test]", strings.NewReader(
+		"echo a\nfor x in a\ndo\n  echo )\ndone\necho b\n"), nil)
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("Next returned error: %v", err)
+	}
+	n, err := r.Next()
+	parseErr, ok := err.(Error)
+	if !ok {
+		t.Fatalf("got error %v, want parse error", err)
+	}
+	if n.line != 2 {
+		t.Errorf("got line %v, want 2", n.line)
+	}
+	first := parseErr.Errors[0]
+	if first.Line != 4 || first.Col != 8 {
+		t.Errorf("got error at %v:%v, want 4:8", first.Line, first.Col)
+	}
+	// The error doesn't end the chunk before "done" appears, since lines are
+	// not parsed again until then.
+	code, err := r.NextCode()
+	if err != nil || code != "echo b\n" {
+		t.Errorf("got %q, %v, want %q, nil", code, err, "echo b\n")
+	}
+}
+
+var removeClosersTests = []struct {
+	name     string
+	unclosed []string
+	line     string
+	aliases  map[string]string
+	want     []string
+}{
+	{"nothing unclosed", nil, "}\n", nil, nil},
+	{"closer absent", []string{"}"}, "echo a\n", nil, []string{"}"}},
+	{"closer present", []string{"}"}, "}\n", nil, nil},
+	{"one of two closers present", []string{"fi", "}"}, "fi\n", nil, []string{"}"}},
+	{"keyword in a longer word", []string{"done"}, "echo undone done_\n", nil, []string{"done"}},
+	{"keyword as a word", []string{"done"}, "echo a; done\n", nil, nil},
+	{"heredoc delimiter", []string{"EOF"}, "EOF\n", nil, nil},
+	{"non-name closer", []string{"'"}, "a'\n", nil, nil},
+	{"braced variable", []string{"}"}, "echo ${x} ${#y}\n", nil, []string{"}"}},
+	{"braced variable after $", []string{"}"}, "echo $${x}\n", nil, nil},
+	{"braced variable after \\", []string{"}"}, "echo \\${x}\n", nil, nil},
+	{"line continuation", []string{"}"}, "echo \\\n", nil, nil},
+	{"alias", []string{"}"}, "ll\n", map[string]string{"ll": "ls -l; }"}, nil},
+	{"not an alias", []string{"}"}, "ls\n", map[string]string{"ll": "ls -l; }"}, []string{"}"}},
+}
+
+func TestReader_removeClosers(t *testing.T) {
+	for _, test := range removeClosersTests {
+		t.Run(test.name, func(t *testing.T) {
+			var aliases Aliases
+			if test.aliases != nil {
+				aliases = func(name string) (string, bool) {
+					text, ok := test.aliases[name]
+					return text, ok
+				}
+			}
+			r := NewReader("[test]", strings.NewReader(""), aliases)
+			got := r.removeClosers(test.unclosed, test.line)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("removeClosers(%q, %q) (-want +got):\n%s",
+					test.unclosed, test.line, diff)
+			}
+		})
+	}
+}
+
+var containsCloserTests = []struct {
+	text   string
+	closer string
+	want   bool
+}{
+	{"}", "}", true},
+	{"echo a}", "}", true},
+	{"echo ${a}", "}", false},
+	{"echo ${a}}", "}", true},
+	{"echo ${a-b}", "}", true},
+	{"fi", "fi", true},
+	{"echo fi", "fi", true},
+	{"echo fix", "fi", false},
+	{"echo _fi", "fi", false},
+	{"echo x; fi; echo fix", "fi", true},
+	{"echo fix; fi", "fi", true},
+	{")", ")", true},
+	{"echo a", ")", false},
+}
+
+func TestContainsCloser(t *testing.T) {
+	for _, test := range containsCloserTests {
+		if got := containsCloser(test.text, test.closer); got != test.want {
+			t.Errorf("containsCloser(%q, %q) = %v, want %v",
+				test.text, test.closer, got, test.want)
+		}
+	}
+}
@@ -22,7 +22,7 @@ command -V ls
 PATH=$PWD
 command -V ls
 ## status: 127
-## stderr: command not found: ls
+## stderr: /bin/sh:2:1: command not found: ls
 
 # TODO: Test for found but not executable; there doesn't seem to be a reliable
 # way to create a file and ensure that it is not executable; the tmpfs may have
@@ -0,0 +1,57 @@
+# POSIX doesn't specify the format of diagnostic messages. This implementation
+# prefixes them with the location of the code that caused them.
+
+#### Diagnostic messages have the location of the command
+echo foo
+  nonexistent-command
+## status: 127
+## stdout: foo
+## stderr: /bin/sh:2:3: command not found: nonexistent-command
+
+#### Diagnostic messages from redirections have the location of the redirection
+echo foo <nonexistent-file
+## status: 2
+## stderr-regexp: /bin/sh:1:10: can't open redirection source: .*\n
+
+#### Diagnostic messages from expansions have the location of the expansion
+set -u
+echo foo $x
+## status: 2
+## stderr: /bin/sh:2:10: x is unset
+
+#### Diagnostic messages from expansions in double quotes have the location of the $
+set -u
+echo "foo ${x}"
+## status: 2
+## stderr: /bin/sh:2:11: x is unset
+
+#### Diagnostic messages from readonly assignments have the location of the assignment
+readonly x=foo
+: ; x=bar
+## status: 2
+## stderr: /bin/sh:2:5: x is readonly
+
+#### Diagnostic messages from sourced files have the name of the file
+echo 'nonexistent-command' > file
+. ./file
+## status: 127
+## stderr: ./file:1:1: command not found: nonexistent-command
+
+#### Diagnostic messages from functions have the name of the file defining them
+echo 'f() { nonexistent-command; }' > file
+. ./file
+f
+## status: 127
+## stderr: ./file:1:7: command not found: nonexistent-command
+
+#### Syntax errors in sourced files have the name of the file
+echo 'echo $(' > file
+. ./file
+## status: 2
+## stderr: ./file:2:1: syntax error: missing closing parenthesis for output capture
+
+#### Diagnostic messages from eval use "eval" as the name
+eval 'echo foo; nonexistent-command'
+## status: 127
+## stdout: foo
+## stderr: eval:1:11: command not found: nonexistent-command
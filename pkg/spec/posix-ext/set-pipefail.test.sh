@@ -0,0 +1,29 @@
+#### Without pipefail, the status of a pipeline is that of the last command
+sh -c 'exit 3' | sh -c 'exit 4' | true
+echo $?
+## stdout: 0
+
+#### pipefail uses the status of the last failed command
+set -o pipefail
+sh -c 'exit 3' | sh -c 'exit 4' | true
+echo $?
+sh -c 'exit 3' | true | true
+echo $?
+true | true
+echo $?
+## STDOUT:
+4
+3
+0
+## END
+
+#### pipefail applies to in-process commands
+set -o pipefail
+(exit 3) | { exit 4; } | :
+echo $?
+## stdout: 4
+
+#### pipefail is shown by set -o
+set -o pipefail
+set +o | grep pipefail
+## stdout: set -o pipefail
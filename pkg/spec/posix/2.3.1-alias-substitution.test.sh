@@ -1,5 +1,3 @@
-# This implementation only supports a limited version of alias substitution.
-
 #### Alias substitution
 alias hello='echo hello'
 hello world
@@ -42,3 +40,96 @@ line2
 line3
 line4
 ## END
+
+#### Alias definition can contain any syntax
+alias lsroot='echo "a  b" | cat; { echo group; }'
+lsroot
+## STDOUT:
+a  b
+group
+## END
+
+#### Alias definition can contain reserved words
+alias loop='for i in 1 2; do'
+loop echo $i; done
+## STDOUT:
+1
+2
+## END
+
+#### Alias definition can start with assignments
+alias setx='x=foo'
+setx; echo $x
+## stdout: foo
+
+#### Command word after assignments and redirections undergoes alias substitution
+alias hello='echo hello'
+x=foo hello world
+>/dev/null hello world
+## stdout: hello world
+
+#### Command words in pipelines and lists undergo alias substitution
+alias hello='echo hello'
+hello | hello world; true && hello again
+## STDOUT:
+hello world
+hello again
+## END
+
+#### Alias definition ending in blank only affects the word after it
+alias echo='echo ll '
+alias ll='not ll'
+echo ll
+## stdout: ll not ll
+
+#### Word after alias definition ending in blank undergoes recursive alias substitution
+alias e='echo '
+alias g=h
+alias h=HH
+e g
+## stdout: HH
+
+#### Alias definition ending in blank can be substituted after another one
+alias e='echo '
+alias f='e '
+f f x
+## stdout: echo x
+
+#### Alias definitions ending in blank all affect the words after them
+alias e='echo '
+alias f='e y '
+alias x=X
+alias y=Y
+f x
+## stdout: Y X
+
+#### Mutually recursive aliases are substituted at most once
+foo() { echo foo "$@"; }
+alias foo='bar 1' bar='foo 2'
+foo 3
+## stdout: foo 2 1 3
+
+#### Reserved words are not eligible for alias substitution
+alias if='echo if'
+if true; then echo then; fi
+## stdout: then
+
+#### Alias defined on the same line doesn't take effect
+alias hello='echo hello'; hello world
+hello again
+## STDOUT:
+hello again
+## END
+## stderr-regexp: .+
+
+#### Alias substitution happens when function definitions are parsed
+alias hello='echo hello'
+f() { hello world; }
+unalias hello
+f
+## stdout: hello world
+
+#### Aliases defined in eval take effect on the next line
+eval 'alias hello="echo hello"
+hello world'
+## stdout: hello world
@@ -90,4 +90,23 @@ echo $0
 /bin/sh
 ## END
 
-# TODO: Test $!
+#### Special parameter $! is unset before any asynchronous list
+echo ${!-unset}
+## stdout: unset
+
+#### Special parameter $! is set by an asynchronous list
+true &
+test "$!" -gt 0 && echo positive
+## stdout: positive
+
+#### Special parameter $! is the PID of an external command
+sleep 10 &
+kill $!
+echo $?
+## stdout: 0
+
+#### Special parameter $! is inherited by subshells
+true &
+pid=$!
+(test "$!" = $pid && echo same)
+## stdout: same
@@ -1,10 +1,74 @@
-# TODO: $ENV?
+# $ENV is only used in interactive shells, which are not covered by these tests.
 
 # $HOME is tested in 2.6.1-tilde-expansion.test.sh
 
 # $IFS is tested in 2.6.5-field-splitting.test.sh
 
-# TODO: $LINENO
+#### $LINENO
+echo $LINENO
+echo \
+  $LINENO
+
+  echo $LINENO; echo $LINENO
+## STDOUT:
+1
+2
+5
+5
+## END
+
+#### $LINENO in functions is the line within the script
+f() {
+  echo $LINENO
+}
+f
+echo $LINENO
+## STDOUT:
+2
+5
+## END
+
+#### $LINENO in sourced files is the line within the file
+printf '\necho $LINENO\n' > file
+. ./file
+echo $LINENO
+## STDOUT:
+2
+3
+## END
+
+#### $LINENO in arithmetic expansion
+echo $((LINENO + 10))
+## stdout: 11
+
+#### $LINENO in words of for
+echo one
+for x in $LINENO; do
+  echo $x $LINENO
+done
+## STDOUT:
+one
+2 3
+## END
+
+#### $LINENO in redirection of compound command
+{
+  echo foo
+} > file$LINENO
+cat file1
+## stdout: foo
+
+#### $LINENO can be assigned
+LINENO=foo
+echo $LINENO
+## stdout: foo
+
+#### $LINENO is not stored as a variable
+set | grep LINENO
+export LINENO
+env | grep LINENO
+echo done
+## stdout: done
 
 # $PATH is tested in 2.9.1-simple-commands.test.sh
 
@@ -12,4 +76,42 @@
 echo $PPID
 ## stdout-regexp: \d+\n
 
+# $PS1 and $PS2 are only used in interactive shells, which are not covered by
+# these tests.
+
+#### $PS4 is used as the prefix of traces
+PS4='trace: '
+set -x
+echo foo
+## stdout: foo
+## stderr: trace: echo foo
+
+#### $PS4 undergoes expansions
+x=foo
+PS4='$x $(echo bar) $((1+2)) '
+set -x
+echo foo
+## stdout: foo
+## stderr: foo bar 3 echo foo
+
+#### Expansion of $PS4 doesn't affect $?
+PS4='$(exit 3)+ '
+set -x
+false
+echo $?
+## STDOUT:
+1
+## END
+## STDERR:
++ false
++ echo 1
+## END
+
+#### Empty $PS4
+PS4=
+set -x
+echo foo
+## stdout: foo
+## stderr: echo foo
+
 # $PWD is tested in cd.test.sh.
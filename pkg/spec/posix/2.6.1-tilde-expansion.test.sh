@@ -20,3 +20,27 @@ HOME='/home/  *'
 touch foo
 printf ': %s\n' ~
 ## stdout: : /home/  *
+
+#### Tilde prefixes in assignment values are also terminated by :
+HOME=/home/user
+x=~:~/foo
+echo $x
+## stdout: /home/user:/home/user/foo
+
+#### Tilde prefixes after unquoted : in assignment values are expanded
+HOME=/home/user
+x=foo:~:~/bar:baz~:\~:"~":~"/quoted"
+echo $x
+## stdout: foo:/home/user:/home/user/bar:baz~:~:~:~/quoted
+
+#### Tilde prefixes after : in ordinary words are not expanded
+HOME=/home/user
+echo foo:~ x=~/foo
+## stdout: foo:~ x=~/foo
+
+#### Tilde prefixes in assignment arguments of export and readonly are expanded
+HOME=/home/user
+export x=~/foo:~ y='~'
+readonly z=foo:~/bar
+echo $x $y $z
+## stdout: /home/user/foo:/home/user ~ foo:/home/user/bar
@@ -147,6 +147,42 @@ printf ': %s\n' "$foo"
 : *
 ## END
 
+#### Argument of substitution operators may contain whitespaces
+printf ': %s\n' ${foo-a  b}
+echo ${bar=foo  bar}
+printf ': %s\n' "$bar"
+printf ': %s\n' "${foo-a  b}"
+## STDOUT:
+: a
+: b
+foo bar
+: foo  bar
+: a  b
+## END
+
+#### Unquoted text in argument of substitution operators undergoes field splitting
+IFS=:
+printf ': %s\n' ${foo-a:b}
+## STDOUT:
+: a
+: b
+## END
+
+#### Argument of substitution operators may contain nested expansions and quotes
+x='x  y'
+printf ': %s\n' ${foo-${bar-$x} "$(echo a)  b" 'c  d'}
+## STDOUT:
+: x
+: y
+: a  b
+: c  d
+## END
+
+#### Argument of ? operators may contain whitespaces
+(: ${foo?must be set to something}) 2>&1 | grep -q 'must be set to something' &&
+  echo ok
+## stdout: ok
+
 #### Length (#)
 echo ${#unset}
 null=
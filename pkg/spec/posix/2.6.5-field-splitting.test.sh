@@ -99,3 +99,37 @@ printf ': %s\n' $x
 : 
 :  d 
 ## END
+
+#### Leading and trailing IFS characters separate fields from adjacent text
+x=' b '
+printf ': %s\n' a${x}c
+y='c:'
+IFS=' :'
+printf ': %s\n' $y"d"
+## STDOUT:
+: a
+: b
+: c
+: c
+: d
+## END
+
+#### Leading non-whitespace IFS character joins empty field with text before
+IFS=:
+x=':b'
+printf ': %s\n' a$x
+printf ': %s\n' $x
+## STDOUT:
+: a
+: b
+: 
+: b
+## END
+
+#### Expansion of only IFS whitespaces separates adjacent text
+x=' '
+printf ': %s\n' a${x}b
+## STDOUT:
+: a
+: b
+## END
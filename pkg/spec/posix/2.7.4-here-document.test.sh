@@ -95,17 +95,29 @@ line2
 42
 ## END
 
-# TODO:
-# 
-# #### Stripping of leading tabs also affect expansions
-# cat <<-EOF
-# 	$(echo '
-# 	foo')
-# 	EOF
-# ## STDOUT:
-# 
-# foo
-# ## END
+#### Stripping of leading tabs also affect expansions
+cat <<-EOF
+	$(echo '
+	foo')
+	${x:-"
+		bar"}
+	EOF
+## STDOUT:
+
+foo
+
+bar
+## END
+
+#### Leading tabs are not stripped after line continuations in <<-
+cat <<-EOF
+	foo\
+	bar $(echo \
+		baz)
+	EOF
+## STDOUT:
+foo	bar baz
+## END
 
 #### Stripping leading tabs with <<- with quoted start word
 cat <<-'EOF'
@@ -142,3 +154,52 @@ EOF
 $x $(echo foo) `echo bar` $(( 7*6 ))
 $x $(echo foo) `echo bar` $(( 7*6 ))
 ## END
+
+#### Quote removal in starting word
+x=variable
+cat <<\EOF
+$x escaped
+EOF
+cat <<E\OF
+$x partially escaped
+EOF
+cat <<"E"'O'F
+$x mixed quotes
+EOF
+cat <<"a\b\"c"
+$x backslash in double quotes
+a\b"c
+## STDOUT:
+$x escaped
+$x partially escaped
+$x mixed quotes
+$x backslash in double quotes
+## END
+
+#### Expansions in starting word are not performed
+x=variable
+cat <<$x
+$x unquoted
+$x
+cat <<"$x"
+$x quoted
+$x
+## STDOUT:
+variable unquoted
+$x quoted
+## END
+
+#### Multiple heredocs with differently quoted starting words on one line
+x=variable
+cat <<A; cat <<"B"; cat <<\C
+$x A
+A
+$x B
+B
+$x C
+C
+## STDOUT:
+variable A
+$x B
+$x C
+## END
@@ -11,4 +11,25 @@ cat3() {
 cat3 4<file 3<&4
 ## stdout: content
 
-# TODO: Test effect of closing FD
+#### Closing standard input
+cat <&- 2>/dev/null
+echo $?
+## stdout: 1
+
+#### Closing standard input causes read to fail
+echo foo | { read x <&-; echo $? "[$x]"; } 2>/dev/null
+## stdout: 1 []
+
+#### Closing an input FD only affects the command
+echo content > file
+exec 3<file
+true 3<&-
+cat <&3
+## stdout: content
+
+#### Duplicating a closed FD is an error
+echo content > file
+cat 3<&- <&3
+echo $?
+## status: 0
+## stdout: 2
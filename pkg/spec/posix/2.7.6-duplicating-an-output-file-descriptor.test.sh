@@ -11,4 +11,65 @@ echo3 content 4>file 3>&4
 cat file
 ## stdout: content
 
-# TODO: Test effect of closing FD
+#### Closing standard output of an external command
+sh -c 'echo foo' >&- 2>/dev/null
+echo $?
+## stdout: 1
+
+#### Writing to a closed FD in a builtin is an error
+pwd >&-
+echo $?
+## stdout: 1
+## stderr: /bin/sh:1:1: pwd: write error: bad file descriptor
+
+#### Builtins not writing to a closed FD are not affected
+cd . >&-
+echo $?
+## stdout: 0
+
+#### Closing stderr
+sh -c 'echo foo >&2; echo bar' 2>&-
+cd /nonexistent 2>&-
+echo $?
+## STDOUT:
+bar
+2
+## END
+## stderr-json: ""
+
+#### Closing an FD permanently with exec
+exec 3>file
+echo foo >&3
+exec 3>&-
+echo bar >&3
+cat file
+## STDOUT:
+foo
+## END
+
+#### Closed FDs are closed in child processes
+exec 3>file
+sh -c 'echo foo >&3' 3>&- 2>/dev/null
+echo $?
+## stdout: 2
+
+#### Closing an FD permanently with exec closes the file
+mkfifo fifo
+cat fifo > out &
+exec 3>fifo
+echo foo >&3
+exec 3>&-
+wait
+cat out
+## stdout: foo
+
+#### Replacing an FD permanently with exec closes the old file
+mkfifo fifo
+cat fifo > out &
+exec 3>fifo 4>&3
+exec 3>file
+echo foo >&4
+exec 4>file
+wait
+cat out
+## stdout: foo
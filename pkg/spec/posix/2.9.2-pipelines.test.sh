@@ -24,3 +24,13 @@ echo $?
 0
 1
 ## END
+
+#### ! negates the status of a pipeline with a single command
+! false
+echo $?
+! true
+echo $?
+## STDOUT:
+0
+1
+## END
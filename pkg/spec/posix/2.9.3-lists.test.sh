@@ -1,8 +1,32 @@
-# TODO:
-# #### Asynchronous list
+#### Asynchronous list
+echo foo &
+## stdout: foo
 
-# TODO:
-# #### Status of asynchronous list is 0
+#### Status of asynchronous list is 0
+false &
+echo $?
+## stdout: 0
+
+#### Asynchronous list runs in a subshell
+x=foo &
+echo ${x-unset}
+## stdout: unset
+
+#### Asynchronous list doesn't read stdin of the shell
+echo foo | {
+    cat &
+    read x
+    echo $x
+}
+## stdout: foo
+
+#### Asynchronous list may be followed by another command on the same line
+echo foo > a & echo bar
+## stdout: bar
+
+#### && and || bind tighter than &
+false && echo foo || echo bar &
+## stdout: bar
 
 #### Sequential list
 echo foo
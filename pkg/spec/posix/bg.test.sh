@@ -0,0 +1,17 @@
+#### bg resumes a stopped job in the background
+set -m
+sh -c 'kill -STOP $$; echo resumed'
+bg
+wait
+jobs
+## STDOUT:
+[1] sh -c 'kill -STOP $$; echo resumed'
+resumed
+## END
+
+#### bg is an error without job control
+sleep 10 &
+bg
+echo $?
+kill $!
+## stdout: 1
@@ -20,4 +20,18 @@ echo should not get here
 ## status: [1, 127]
 ## stderr-regexp: .+
 
+#### . reads a long command spanning many lines
+# This used to take time quadratic in the number of lines.
+digits='0 1 2 3 4 5 6 7 8 9'
+body=
+for a in $digits; do for b in $digits; do for c in $digits; do
+  body="$body  x=\${x}$a$b$c; if true; then :; fi
+"
+done; done; done
+printf 'f() {\n%s}\n' "$body" > module
+. ./module
+f
+echo ${#x}
+## stdout: 3000
+
 # Behavior of return within a sourced file is tested in return.test.sh
@@ -0,0 +1,77 @@
+# Note: The tests can't use exec with a command in the top-level shell, since
+# that would replace the process running the tests.
+
+#### exec without a command makes redirections permanent
+exec 3>file
+echo foo >&3
+echo bar >&3
+cat file
+## STDOUT:
+foo
+bar
+## END
+
+#### exec can redirect stdout permanently
+exec 3>&1 >file
+echo foo
+exec >&3
+echo bar
+cat file
+## STDOUT:
+bar
+foo
+## END
+
+#### exec with input redirections
+printf 'foo\nbar\n' > file
+exec 3<file
+read x <&3
+read y <&3
+echo $x $y
+## stdout: foo bar
+
+#### exec without a command has status 0
+false
+exec
+echo $?
+## stdout: 0
+
+#### exec in a subshell runs the command and ends the subshell
+(exec echo foo; echo unreachable)
+echo status $?
+(exec sh -c 'exit 3'; echo unreachable)
+echo status $?
+## STDOUT:
+foo
+status 0
+status 3
+## END
+
+#### exec in the last command of a pipeline only ends the pipeline
+echo foo | exec cat
+echo bar
+## STDOUT:
+foo
+bar
+## END
+
+#### exec doesn't run functions or builtins
+echo() { :; }
+(exec echo foo)
+## stdout: foo
+
+#### exec in a subshell with a nonexistent command
+(exec nonexistent-command; echo unreachable)
+echo $?
+## stdout: 127
+
+#### exec in a subshell uses the virtual working directory and exported variables
+mkdir d
+cd d
+export FOO=foo
+BAR=bar
+(exec sh -c 'basename $PWD; echo $FOO $BAR')
+## STDOUT:
+d
+foo
+## END
@@ -16,4 +16,11 @@ echo should not get here
 echo $?
 ## stdout: 10
 
-# TODO: Test behavior of exit within trap
+#### exit within trap uses $? before the trap action by default
+trap 'false; exit' USR1
+true
+kill -USR1 $$
+sleep 0.1
+echo should not get here
+## status: 0
+## stdout-json: ""
@@ -0,0 +1,179 @@
+# Commands are only added to the history by interactive shells, which are not
+# covered by these tests. Instead, the history is loaded from $HISTFILE.
+
+#### fc -l lists the last commands
+printf 'echo one\necho two\necho three\n' > hist
+HISTFILE=hist
+fc -l
+## STDOUT:
+1	echo one
+2	echo two
+3	echo three
+## END
+
+#### fc -l with ranges
+printf 'echo one\necho two\necho three\necho four\n' > hist
+HISTFILE=hist
+fc -l 2 3
+echo
+fc -l -2
+echo
+fc -l 'echo t' 4
+echo
+fc -l 3 1
+## STDOUT:
+2	echo two
+3	echo three
+
+3	echo three
+4	echo four
+
+3	echo three
+4	echo four
+
+3	echo three
+2	echo two
+1	echo one
+## END
+
+#### fc -l clamps numbers out of range
+printf 'echo one\necho two\n' > hist
+HISTFILE=hist
+fc -l 0 10
+## STDOUT:
+2	echo two
+## END
+
+#### fc -l -r and -n
+printf 'echo one\necho two\n' > hist
+HISTFILE=hist
+fc -lnr
+## STDOUT:
+	echo two
+	echo one
+## END
+
+#### fc -l with multi-line commands
+printf 'for x in a b; do\n  echo $x\ndone\necho one\n' > hist
+HISTFILE=hist
+fc -l
+## STDOUT:
+1	for x in a b; do
+	  echo $x
+	done
+2	echo one
+## END
+
+#### fc -l with an empty history
+HISTFILE=hist
+fc -l
+echo $?
+## stdout: 0
+
+#### fc -l fails when no command matches
+printf 'echo one\n' > hist
+HISTFILE=hist
+fc -l nonexistent
+echo $?
+## stdout: 1
+
+#### $HISTSIZE limits the number of commands
+printf 'echo one\necho two\necho three\n' > hist
+HISTFILE=hist
+HISTSIZE=2
+fc -l
+cat hist
+## STDOUT:
+2	echo two
+3	echo three
+echo two
+echo three
+## END
+
+#### fc -s re-executes a command
+printf 'echo one\necho two\n' > hist
+HISTFILE=hist
+fc -s
+fc -s 1
+## STDOUT:
+echo two
+two
+echo one
+one
+## END
+
+#### fc -s with substitution
+printf 'echo one; echo one\n' > hist
+HISTFILE=hist
+fc -s one=two echo
+## STDOUT:
+echo two; echo one
+two
+one
+## END
+
+#### fc -s returns the status of the command
+printf 'false\n' > hist
+HISTFILE=hist
+fc -s
+echo $?
+## STDOUT:
+false
+1
+## END
+
+#### fc edits commands with $FCEDIT and executes them
+printf 'echo one\necho two\n' > hist
+HISTFILE=hist
+edit() { { echo 'echo edited'; cat "$1"; } > new; mv new "$1"; }
+FCEDIT=edit
+fc 1 2
+## STDOUT:
+echo edited
+echo one
+echo two
+edited
+one
+two
+## END
+
+#### fc -e overrides $FCEDIT
+printf 'echo one\n' > hist
+HISTFILE=hist
+FCEDIT=false
+fc -e : -1
+## STDOUT:
+echo one
+one
+## END
+
+#### fc doesn't execute commands when the editor fails
+printf 'echo one\n' > hist
+HISTFILE=hist
+fc -e false
+echo $?
+## stdout: 1
+
+#### exit in commands run by fc exits the shell
+printf 'exit 5\n' > hist
+HISTFILE=hist
+fc -s
+echo should not get here
+## status: 5
+## stdout: exit 5
+
+#### Fatal errors in commands run by fc abort the shell
+printf 'unset x; echo $x\n' > hist
+HISTFILE=hist
+set -u
+fc -s
+echo should not get here
+## status: [1, 127]
+## stdout: unset x; echo $x
+## stderr-regexp: .+
+
+#### non-interactive shells don't default HISTFILE to $HOME/.sh_history
+HOME=$PWD
+echo 'echo from history' > .sh_history
+fc -l
+## stdout-json: ""
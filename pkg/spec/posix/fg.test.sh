@@ -0,0 +1,43 @@
+#### fg waits for a job and returns its status
+set -m
+(exit 3) &
+fg
+echo $?
+## STDOUT:
+(exit 3)
+3
+## END
+
+#### fg resumes a stopped job
+set -m
+sh -c 'kill -STOP $$; echo resumed'
+fg %1
+echo $?
+jobs
+## STDOUT:
+sh -c 'kill -STOP $$; echo resumed'
+resumed
+0
+## END
+
+#### fg reports a job stopped again
+set -m
+sh -c 'kill -STOP $$; kill -STOP $$; echo resumed'
+fg
+echo $?
+kill -KILL $(jobs -p)
+## STDOUT:
+sh -c 'kill -STOP $$; kill -STOP $$; echo resumed'
+147
+## END
+## STDERR:
+[1] + Stopped sh -c 'kill -STOP $$; kill -STOP $$; echo resumed'
+[1] + Stopped sh -c 'kill -STOP $$; kill -STOP $$; echo resumed'
+## END
+
+#### fg is an error without job control
+sleep 10 &
+fg
+echo $?
+kill $!
+## stdout: 1
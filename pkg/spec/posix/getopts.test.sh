@@ -0,0 +1,139 @@
+#### getopts parses options without arguments
+set -- -a -b foo
+while getopts ab opt; do
+  echo $opt
+done
+echo $OPTIND
+## STDOUT:
+a
+b
+3
+## END
+
+#### getopts parses grouped options
+set -- -ab -c
+while getopts abc opt; do
+  echo $opt $OPTIND
+done
+## STDOUT:
+a 1
+b 2
+c 3
+## END
+
+#### getopts parses option arguments
+set -- -a foo -bbar -c
+while getopts a:b:c opt; do
+  echo $opt ${OPTARG-unset}
+done
+echo $OPTIND
+## STDOUT:
+a foo
+b bar
+c unset
+5
+## END
+
+#### getopts parses option argument after grouped options
+set -- -cafoo bar
+getopts a:c opt; echo $opt
+getopts a:c opt; echo $opt $OPTARG
+echo $OPTIND
+## STDOUT:
+c
+a foo
+2
+## END
+
+#### getopts stops at --
+set -- -a -- -b
+while getopts ab opt; do
+  echo $opt
+done
+echo $opt $OPTIND
+## STDOUT:
+a
+? 3
+## END
+
+#### getopts stops at non-option argument
+set -- -a - -b
+while getopts ab opt; do
+  echo $opt
+done
+echo $opt $OPTIND
+## STDOUT:
+a
+? 2
+## END
+
+#### getopts parses explicit arguments instead of positional parameters
+set -- -a
+getopts ab opt -b
+echo $opt
+## stdout: b
+
+#### getopts reports invalid option
+set -- -x
+getopts ab opt 2>err
+echo $? $opt ${OPTARG-unset}
+grep -c 'illegal option -- x' err
+## STDOUT:
+0 ? unset
+1
+## END
+
+#### getopts reports missing option argument
+set -- -a
+getopts a: opt 2>err
+echo $? $opt ${OPTARG-unset}
+grep -c 'option requires an argument -- a' err
+## STDOUT:
+0 ? unset
+1
+## END
+
+#### getopts in silent mode reports invalid option in OPTARG
+set -- -x
+getopts :ab opt
+echo $? $opt $OPTARG
+## stdout: 0 ? x
+## stderr-json: ""
+
+#### getopts in silent mode reports missing option argument with :
+set -- -a
+getopts :a: opt
+echo $? $opt $OPTARG
+## stdout: 0 : a
+## stderr-json: ""
+
+#### getopts restarts when OPTIND is set to 1
+set -- -ab
+getopts ab opt; echo $opt
+OPTIND=1
+getopts ab opt; echo $opt
+getopts ab opt; echo $opt
+## STDOUT:
+a
+a
+b
+## END
+
+#### getopts can be used in functions
+f() {
+  OPTIND=1
+  while getopts x: opt; do
+    echo $opt $OPTARG
+  done
+}
+f -x foo
+f -x bar
+## STDOUT:
+x foo
+x bar
+## END
+
+#### getopts without enough arguments
+getopts ab
+echo $?
+## stdout: 2
@@ -0,0 +1,56 @@
+#### hash remembers location of commands
+hash cat
+test "$(hash)" = "cat=$(command -v cat)" && echo ok
+## stdout: ok
+
+#### running external commands remembers their locations
+cat </dev/null
+test "$(hash)" = "cat=$(command -v cat)" && echo ok
+## stdout: ok
+
+#### hash doesn't remember builtins, functions or paths
+f() { :; }
+hash : f cd /bin/cat
+hash
+## stdout-json: ""
+
+#### hash -r forgets all locations
+hash cat
+hash -r
+hash
+## stdout-json: ""
+
+#### hash fails on commands not found
+hash nonexistent-command
+status=$?
+hash
+echo $status
+## stdout: 1
+
+#### assigning PATH forgets all locations
+hash cat
+PATH=$PATH
+hash
+## stdout-json: ""
+
+#### remembered locations are used instead of searching PATH
+mkdir bin1 bin2
+printf '#!/bin/sh\necho bin2\n' > bin2/cmd
+chmod +x bin2/cmd
+PATH=$PWD/bin1:$PWD/bin2:$PATH
+cmd
+printf '#!/bin/sh\necho bin1\n' > bin1/cmd
+chmod +x bin1/cmd
+cmd
+hash -r
+cmd
+## STDOUT:
+bin2
+bin2
+bin1
+## END
+
+#### locations remembered in subshells are forgotten
+(hash cat)
+hash
+## stdout-json: ""
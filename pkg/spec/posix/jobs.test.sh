@@ -0,0 +1,73 @@
+#### jobs lists running jobs
+set -m
+sleep 10 &
+jobs
+kill $!
+## stdout: [1] + Running sleep 10
+
+#### jobs marks the current and previous jobs
+set -m
+sleep 10 &
+sleep 20 &
+jobs
+kill %1 %2 2>/dev/null || kill $(jobs -p)
+## STDOUT:
+[1] - Running sleep 10
+[2] + Running sleep 20
+## END
+
+#### jobs -p prints process group IDs
+set -m
+sleep 10 &
+pid=$!
+test "$(jobs -p)" = $pid && echo ok
+kill $pid
+## stdout: ok
+
+#### jobs reports and forgets finished jobs
+set -m
+(exit 3) &
+sleep 0.1
+jobs
+jobs
+## stdout: [1] + Done(3) (exit 3)
+
+#### jobs with job IDs
+set -m
+sleep 10 &
+sleep 20 &
+jobs %1 %sleep\ 2
+kill $(jobs -p)
+## STDOUT:
+[1] - Running sleep 10
+[2] + Running sleep 20
+## END
+
+#### jobs with a nonexistent job
+jobs %1
+echo $?
+## stdout: 1
+
+#### A stopped foreground job is added to the job table
+set -m
+sh -c 'kill -STOP $$; echo resumed'
+echo $?
+jobs
+kill -KILL $(jobs -p)
+## STDOUT:
+147
+[1] + Stopped sh -c 'kill -STOP $$; echo resumed'
+## END
+## stderr: [1] + Stopped sh -c 'kill -STOP $$; echo resumed'
+
+#### Remaining commands continue after a foreground job is stopped
+set -m
+sh -c 'kill -STOP $$' && echo and
+sh -c 'kill -STOP $$' || echo or
+jobs
+kill -KILL $(jobs -p)
+## STDOUT:
+or
+[1] - Stopped sh -c 'kill -STOP $$'
+[2] + Stopped sh -c 'kill -STOP $$'
+## END
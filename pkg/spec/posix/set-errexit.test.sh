@@ -0,0 +1,174 @@
+#### set -o errexit causes the shell to exit on failed simple commands
+set -o errexit
+echo foo
+false
+echo bar
+## status: 1
+## stdout: foo
+
+#### set -e is equivalent to set -o errexit
+set -e
+sh -c 'exit 3'
+echo unreachable
+## status: 3
+## stdout-json: ""
+
+#### set -e runs the EXIT trap
+trap 'echo bye' EXIT
+set -e
+false
+## status: 1
+## stdout: bye
+
+#### set -e applies to failed pipelines
+set -e
+false | true
+echo foo
+true | false
+echo bar
+## status: 1
+## stdout: foo
+
+#### set -e applies to failed subshells
+set -e
+(false; echo unreachable)
+echo unreachable
+## status: 1
+## stdout-json: ""
+
+#### set -e applies to failed subshells even when the failure was ignored
+set -e
+(false && true)
+echo unreachable
+## status: 1
+## stdout-json: ""
+
+#### set -e applies to failed function calls
+set -e
+f() {
+    false && true
+}
+f
+echo unreachable
+## status: 1
+## stdout-json: ""
+
+#### set -e applies within compound commands
+set -e
+for x in foo bar; do
+    echo $x
+    false
+done
+## status: 1
+## stdout: foo
+
+#### set -e is ignored in the condition of if
+set -e
+if false; then
+    echo unreachable
+elif false; then
+    echo unreachable
+fi
+echo foo
+## status: 0
+## stdout: foo
+
+#### set -e is ignored in the condition of while and until
+set -e
+while false; do :; done
+until true; do :; done
+i=0
+until [ $i = 2 ]; do i=$(( i + 1 )); false; echo unreachable; done
+## status: 1
+## stdout-json: ""
+
+#### set -e is ignored in pipelines beginning with !
+set -e
+! true
+! false
+echo foo
+## status: 0
+## stdout: foo
+
+#### set -e is ignored for all but the last pipeline in an AND-OR list
+set -e
+false && true
+false || true
+true && false || true
+echo foo
+false || false
+echo unreachable
+## status: 1
+## stdout: foo
+
+#### set -e doesn't apply to compound commands that failed while it was ignored
+set -e
+{ false && true; }
+echo foo
+if true; then false && true; fi
+echo bar
+## status: 0
+## STDOUT:
+foo
+bar
+## END
+
+#### set -e applies to redirection failures of compound commands
+set -e
+{ echo foo; } </nonexistent
+echo unreachable
+## status: [1, 2]
+## stdout-json: ""
+
+#### set -e doesn't apply to redirection failures of compound commands while ignored
+set -e
+if { :; } </nonexistent; then :; fi
+! { :; } </nonexistent
+{ :; } </nonexistent || echo foo
+for x in a; do :; done </nonexistent | cat
+echo bar
+## STDOUT:
+foo
+bar
+## END
+
+#### Ignoring set -e propagates through function calls
+set -e
+f() {
+    false
+    echo in f
+}
+if f; then
+    echo ok
+fi
+f && echo ok
+f
+echo unreachable
+## status: 1
+## STDOUT:
+in f
+ok
+in f
+ok
+## END
+
+#### set -e applies in subshells
+set -e
+x=$(false; echo unreachable)
+echo unreachable
+## status: 1
+## stdout-json: ""
+
+#### set -e doesn't apply to asynchronous lists
+set -e
+false &
+echo foo
+## status: 0
+## stdout: foo
+
+#### set +e turns off errexit
+set -e
+set +e
+false
+echo foo
+## stdout: foo
@@ -0,0 +1,60 @@
+#### set -o noexec causes commands to not be executed
+echo foo
+set -o noexec
+echo bar
+x=$(echo baz > file)
+set +n
+echo quux
+test -e file && echo file exists
+## stdout: foo
+
+#### set -n is equivalent to set -o noexec
+set -n
+echo foo
+## stdout-json: ""
+
+#### set -n checks the syntax of files sourced with literal paths
+printf 'echo ok\nif true; then\n  echo "foo\n' > bad.sh
+printf '. ./bad.sh\n' > indirect.sh
+set -n
+. ./bad.sh
+. "./indirect.sh"
+## STDERR:
+./bad.sh:4:1: syntax error: unterminated double-quoted string
+./bad.sh:4:1: syntax error: expect "fi", "else" or "elif"
+./bad.sh:4:1: syntax error: unterminated double-quoted string
+./bad.sh:4:1: syntax error: expect "fi", "else" or "elif"
+## END
+
+#### set -n doesn't follow files sourced with non-literal paths
+printf 'echo "foo\n' > bad.sh
+name=bad.sh
+set -n
+. ./$name
+## stderr-json: ""
+
+#### set -n doesn't report missing sourced files
+set -n
+. ./nonexistent.sh
+## status: 0
+## stderr-json: ""
+
+#### set -n keeps checking after a syntax error
+set -n
+echo )
+echo ok
+if true; done
+## status: 2
+## STDERR:
+/bin/sh:2:6: syntax error: unparsed code
+/bin/sh:4:10: syntax error: unexpected keyword "done"
+## END
+
+#### set -n reports all syntax errors in sourced files
+printf 'echo )\necho ok\nif true; done\n' > bad.sh
+set -n
+. ./bad.sh
+## STDERR:
+./bad.sh:1:6: syntax error: unparsed code
+./bad.sh:3:10: syntax error: unexpected keyword "done"
+## END
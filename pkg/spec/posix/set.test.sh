@@ -18,3 +18,16 @@ echo $#
 ## stdout: 0
 
 # TODO: Test set -o and set +o
+
+#### set -o vi and set -o emacs turn each other off
+set -o vi
+set -o emacs
+set +o | grep -e ' vi$' -e ' emacs$'
+set -o vi
+set +o | grep -e ' vi$' -e ' emacs$'
+## STDOUT:
+set -o emacs
+set +o vi
+set +o emacs
+set -o vi
+## END
@@ -0,0 +1,130 @@
+#### EXIT trap runs when the script finishes
+trap 'echo bye' EXIT
+echo hi
+## STDOUT:
+hi
+bye
+## END
+
+#### EXIT trap runs when exit is called
+trap 'echo bye' EXIT
+exit 3
+echo unreachable
+## status: 3
+## stdout: bye
+
+#### EXIT trap runs only once
+trap 'echo bye' EXIT
+exit
+## stdout: bye
+
+#### $? in EXIT trap is the exit status
+trap 'echo $?' EXIT
+exit 4
+## status: 4
+## stdout: 4
+
+#### exit in EXIT trap sets the exit status
+trap 'exit 5' EXIT
+exit 4
+## status: 5
+
+#### 0 is the same as EXIT
+trap 'echo bye' 0
+## stdout: bye
+
+#### Trap on signal
+trap 'echo caught' USR1
+kill -USR1 $$
+sleep 0.1
+echo after
+## STDOUT:
+caught
+after
+## END
+
+#### Signal name may have SIG prefix
+trap 'echo caught' SIGUSR1
+kill -USR1 $$
+sleep 0.1
+## stdout: caught
+
+#### $? is restored after trap action
+trap 'false' USR1
+kill -USR1 $$
+sleep 0.1
+echo $?
+## stdout: 0
+
+#### Ignoring a signal
+trap '' USR2
+kill -USR2 $$
+sleep 0.1
+echo alive
+## stdout: alive
+
+#### Printing traps
+trap 'echo bye' EXIT
+trap '' USR1
+trap "echo 'quoted'" HUP
+trap
+trap - EXIT
+## STDOUT:
+trap -- 'echo bye' EXIT
+trap -- 'echo '\''quoted'\''' HUP
+trap -- '' USR1
+## END
+
+#### Resetting traps with -
+trap 'echo bye' EXIT
+trap - EXIT
+trap
+## stdout-json: ""
+
+#### Resetting traps when the first operand is a number
+trap 'echo bye' EXIT
+trap 0
+trap
+## stdout-json: ""
+
+#### Invalid condition is not a fatal error
+trap 'echo foo' BADSIG EXIT
+echo $?
+## STDOUT:
+1
+foo
+## END
+
+#### Traps are reset in subshells
+trap 'echo bye' EXIT
+(echo subshell)
+## STDOUT:
+subshell
+bye
+## END
+
+#### EXIT trap set in subshell runs when the subshell exits
+(trap 'echo subshell bye' EXIT; echo subshell)
+echo main
+## STDOUT:
+subshell
+subshell bye
+main
+## END
+
+#### EXIT trap in command substitution
+x=$(trap 'echo bye' EXIT; echo hi)
+echo $x
+## stdout: hi bye
+
+#### Ignored traps are inherited by subshells
+trap '' USR1
+(trap)
+## stdout: trap -- '' USR1
+
+#### Printing traps of the parent shell in command substitution
+trap 'echo bye' EXIT
+traps=$(trap)
+trap - EXIT
+eval "$traps"
+## stdout: bye
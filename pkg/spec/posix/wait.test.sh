@@ -0,0 +1,110 @@
+#### wait with no arguments waits for all jobs
+{ sleep 0.1; echo foo > a; } &
+{ sleep 0.1; echo bar > b; } &
+wait
+cat a b
+## STDOUT:
+foo
+bar
+## END
+
+#### Status of wait with no arguments is 0
+(exit 3) &
+wait
+echo $?
+## stdout: 0
+
+#### wait with a PID returns the status of the job
+(exit 3) &
+wait $!
+echo $?
+sh -c 'exit 4' &
+wait $!
+echo $?
+## STDOUT:
+3
+4
+## END
+
+#### wait returns 128 plus the signal number for killed jobs
+sleep 10 &
+kill -TERM $!
+wait $!
+echo $?
+## stdout: 143
+
+#### wait with multiple PIDs returns the status of the last one
+(exit 3) &
+pid1=$!
+(exit 4) &
+pid2=$!
+wait $pid2 $pid1
+echo $?
+## stdout: 3
+
+#### wait with an unknown PID returns 127
+wait 12345678
+echo $?
+## stdout: 127
+
+#### A job can only be waited once
+(exit 3) &
+wait $!
+wait $!
+echo $?
+## stdout: 127
+
+#### wait with job number
+(sleep 0.1; exit 3) &
+(exit 4) &
+wait %1
+echo $?
+## stdout: 3
+
+#### wait with current and previous job
+(sleep 0.1; exit 3) &
+(exit 4) &
+wait %-
+echo $?
+wait %%
+echo $?
+## STDOUT:
+3
+4
+## END
+
+#### wait with job prefix and substring
+sh -c 'sleep 0.1; exit 3' &
+sleep 0 &
+wait %sh
+echo $?
+wait %?0
+echo $?
+## STDOUT:
+3
+0
+## END
+
+#### Finished jobs are removed when another job is started
+(exit 3) &
+pid=$!
+sleep 0.1
+sleep 10 &
+jobs
+kill $!
+wait $pid
+echo $?
+## STDOUT:
+[1] + Running sleep 10
+3
+## END
+
+#### Subshells don't inherit jobs
+(exit 3) &
+(wait $!; echo $?)
+## stdout: 127
+
+#### wait with invalid job ID is an error
+wait foo
+## status: [1, 127]
+## stderr-regexp: .+
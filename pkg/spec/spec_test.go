@@ -58,7 +58,7 @@ func TestSpecs(t *testing.T) {
 				argv = []string{"/bin/sh"}
 			}
 			ev := eval.NewEvaler(argv, files)
-			status := ev.Eval(spec.code)
+			status := ev.RunExitTrap(ev.Eval(spec.code))
 			stdout, stderr := read()
 
 			if len(spec.wantStatus) > 0 {